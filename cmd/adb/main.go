@@ -20,7 +20,7 @@ func Execute(args *Args, cmd *cobra.Command, _ []string) error {
 	}
 
 	runtime := vm.NewVM(opts...)
-	if err := runtime.Interpret("5*5+7-2"); err != nil {
+	if err := runtime.Interpret("print 5*5+7-2;"); err != nil {
 		return err
 	}
 
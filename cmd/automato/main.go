@@ -3,20 +3,41 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io/fs"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 
 	"github.com/spf13/cobra"
 
-	"github.com/meanguy/automato/internal/mem"
 	"github.com/meanguy/automato/internal/vm"
 )
 
 type Args struct {
-	Debug bool
+	Debug      bool
+	SearchPath []string
+}
+
+// rootsFS exposes the directories roots of fsys and everything below them, and nothing else.
+type rootsFS struct {
+	fsys  fs.FS
+	roots []string
 }
 
 func Execute(opts *Args, cmd *cobra.Command, args []string) error {
-	vmOpts := []vm.VMOption{}
+	fsys, script, searchPath := fs.FS(os.DirFS(".")), "", opts.SearchPath
+	if len(args) > 0 {
+		var err error
+		if fsys, script, searchPath, err = scriptFS(args[0], opts.SearchPath); err != nil {
+			return err
+		}
+	}
+
+	vmOpts := []vm.VMOption{
+		vm.WithFS(fsys),
+		vm.WithSearchPath(searchPath...),
+	}
 	if opts.Debug {
 		vmOpts = append(vmOpts, vm.EnableDebug())
 	}
@@ -26,7 +47,65 @@ func Execute(opts *Args, cmd *cobra.Command, args []string) error {
 		return REPL(automato)
 	}
 
-	return automato.InterpretChunk(&mem.Chunk{})
+	return automato.InterpretFile(script)
+}
+
+// scriptFS returns a file system holding script, along with the paths of script and the search
+// path directories in it, so scripts run from anywhere on their volume. Paths are relative to
+// the root of the volume, but only the directory of script and the search path directories
+// can be opened, so imports can't reach the rest of the volume.
+func scriptFS(script string, searchPath []string) (fs.FS, string, []string, error) {
+	abs, err := filepath.Abs(script)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	root := filepath.VolumeName(abs) + string(filepath.Separator)
+
+	name, err := rootedPath(root, abs)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	dirs := make([]string, 0, len(searchPath))
+	roots := []string{path.Dir(name)}
+
+	for _, dir := range searchPath {
+		rooted, err := rootedPath(root, dir)
+		if err != nil {
+			return nil, "", nil, err
+		}
+
+		dirs = append(dirs, rooted)
+		roots = append(roots, rooted)
+	}
+
+	return rootsFS{fsys: os.DirFS(root), roots: roots}, name, dirs, nil
+}
+
+// rootedPath returns name as a slash-separated path relative to root.
+func rootedPath(root, name string) (string, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(root, abs)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.ToSlash(rel), nil
+}
+
+func (r rootsFS) Open(name string) (fs.File, error) {
+	for _, root := range r.roots {
+		if root == "." || name == root || strings.HasPrefix(name, root+"/") {
+			return r.fsys.Open(name)
+		}
+	}
+
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
 }
 
 func REPL(vm *vm.VM) error {
@@ -40,7 +119,7 @@ func REPL(vm *vm.VM) error {
 		}
 
 		if err := vm.Interpret(scan.Text()); err != nil {
-			return err
+			fmt.Fprintln(os.Stderr, err.Error())
 		}
 	}
 }
@@ -56,6 +135,7 @@ func main() {
 	}
 
 	cmd.PersistentFlags().BoolVar(&opts.Debug, "debug", false, "enable debug tracing")
+	cmd.PersistentFlags().StringSliceVar(&opts.SearchPath, "path", nil, "directories to search for imported modules")
 
 	if err := cmd.Execute(); err != nil {
 		fmt.Fprint(os.Stderr, err.Error())
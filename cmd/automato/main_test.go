@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/meanguy/automato/internal/vm"
+)
+
+func TestExecuteScriptPaths(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"p/i.ato":          `import "lib.ato" as lib; throw lib.message;`,
+		"p/lib.ato":        `var message = "ran";`,
+		"p/s.ato":          `import "shared.ato" as shared; throw shared.message;`,
+		"lib/shared.ato":   `var message = "shared";`,
+		"p/escape.ato":     `import "../lib/shared.ato" as shared; throw shared.message;`,
+		"cwd/.placeholder": "",
+	}
+
+	for name, source := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		assert.NoError(t, os.WriteFile(path, []byte(source), 0o600))
+	}
+
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(filepath.Join(dir, "cwd")))
+
+	defer func() { assert.NoError(t, os.Chdir(wd)) }()
+
+	testCases := []struct {
+		name       string
+		script     string
+		searchPath []string
+		message    string
+	}{
+		{"absolute path", filepath.Join(dir, "p", "i.ato"), nil, "uncaught exception: ran"},
+		{"parent directory", filepath.Join("..", "p", "i.ato"), nil, "uncaught exception: ran"},
+		{
+			name:       "absolute search path",
+			script:     filepath.Join(dir, "p", "s.ato"),
+			searchPath: []string{filepath.Join(dir, "lib")},
+			message:    "uncaught exception: shared",
+		},
+		{
+			name:       "relative search path",
+			script:     filepath.Join("..", "p", "s.ato"),
+			searchPath: []string{filepath.Join("..", "lib")},
+			message:    "uncaught exception: shared",
+		},
+		{
+			name:       "import outside the script's directory",
+			script:     filepath.Join(dir, "p", "escape.ato"),
+			searchPath: nil,
+			message:    "can't find module '../lib/shared.ato'",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var rtErr *vm.RuntimeError
+
+			err := Execute(&Args{Debug: false, SearchPath: tc.searchPath}, nil, []string{tc.script})
+			assert.True(t, errors.As(err, &rtErr))
+			assert.Equal(t, tc.message, rtErr.Message)
+		})
+	}
+}
@@ -3,8 +3,11 @@ package debug
 import (
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 
 	"github.com/meanguy/automato/internal/mem"
+	"github.com/meanguy/automato/internal/object"
 	"github.com/meanguy/automato/internal/opcode"
 	"github.com/meanguy/automato/internal/value"
 )
@@ -36,8 +39,22 @@ func DisassembleInstruction(w io.Writer, chunk *mem.Chunk, offset int) int {
 		return constantInstruction(w, "OpConstant", chunk, offset)
 	case opcode.OpConstantLong:
 		return constantLongInstruction(w, "OpConstantLong", chunk, offset)
+	case opcode.OpNil:
+		return simpleInstruction(w, "OpNil", offset)
+	case opcode.OpTrue:
+		return simpleInstruction(w, "OpTrue", offset)
+	case opcode.OpFalse:
+		return simpleInstruction(w, "OpFalse", offset)
 	case opcode.OpNegate:
 		return simpleInstruction(w, "OpNegate", offset)
+	case opcode.OpNot:
+		return simpleInstruction(w, "OpNot", offset)
+	case opcode.OpEqual:
+		return simpleInstruction(w, "OpEqual", offset)
+	case opcode.OpGreater:
+		return simpleInstruction(w, "OpGreater", offset)
+	case opcode.OpLess:
+		return simpleInstruction(w, "OpLess", offset)
 	case opcode.OpAdd:
 		return simpleInstruction(w, "OpAdd", offset)
 	case opcode.OpSubtract:
@@ -46,6 +63,114 @@ func DisassembleInstruction(w io.Writer, chunk *mem.Chunk, offset int) int {
 		return simpleInstruction(w, "OpMultiply", offset)
 	case opcode.OpDivide:
 		return simpleInstruction(w, "OpDivide", offset)
+	case opcode.OpPrint:
+		return simpleInstruction(w, "OpPrint", offset)
+	case opcode.OpPop:
+		return simpleInstruction(w, "OpPop", offset)
+	case opcode.OpDefineGlobal:
+		return constantLongInstruction(w, "OpDefineGlobal", chunk, offset)
+	case opcode.OpGetGlobal:
+		return constantLongInstruction(w, "OpGetGlobal", chunk, offset)
+	case opcode.OpSetGlobal:
+		return constantLongInstruction(w, "OpSetGlobal", chunk, offset)
+	case opcode.OpGetLocal:
+		return localInstruction(w, "OpGetLocal", chunk, offset)
+	case opcode.OpSetLocal:
+		return localInstruction(w, "OpSetLocal", chunk, offset)
+	case opcode.OpJump:
+		return jumpInstruction(w, "OpJump", 1, chunk, offset)
+	case opcode.OpJumpIfFalse:
+		return jumpInstruction(w, "OpJumpIfFalse", 1, chunk, offset)
+	case opcode.OpLoop:
+		return jumpInstruction(w, "OpLoop", -1, chunk, offset)
+	case opcode.OpCall:
+		return byteInstruction(w, "OpCall", chunk, offset)
+	case opcode.OpClosure:
+		return closureInstruction(w, "OpClosure", chunk, offset)
+	case opcode.OpGetUpvalue:
+		return byteInstruction(w, "OpGetUpvalue", chunk, offset)
+	case opcode.OpSetUpvalue:
+		return byteInstruction(w, "OpSetUpvalue", chunk, offset)
+	case opcode.OpCloseUpvalue:
+		return simpleInstruction(w, "OpCloseUpvalue", offset)
+	case opcode.OpClass:
+		return constantLongInstruction(w, "OpClass", chunk, offset)
+	case opcode.OpMethod:
+		return constantLongInstruction(w, "OpMethod", chunk, offset)
+	case opcode.OpGetProperty:
+		return constantLongInstruction(w, "OpGetProperty", chunk, offset)
+	case opcode.OpSetProperty:
+		return constantLongInstruction(w, "OpSetProperty", chunk, offset)
+	case opcode.OpInvoke:
+		return invokeInstruction(w, "OpInvoke", chunk, offset)
+	case opcode.OpInherit:
+		return simpleInstruction(w, "OpInherit", offset)
+	case opcode.OpGetSuper:
+		return constantLongInstruction(w, "OpGetSuper", chunk, offset)
+	case opcode.OpSuperInvoke:
+		return invokeInstruction(w, "OpSuperInvoke", chunk, offset)
+	case opcode.OpModulo:
+		return simpleInstruction(w, "OpModulo", offset)
+	case opcode.OpBitAnd:
+		return simpleInstruction(w, "OpBitAnd", offset)
+	case opcode.OpBitOr:
+		return simpleInstruction(w, "OpBitOr", offset)
+	case opcode.OpBitXor:
+		return simpleInstruction(w, "OpBitXor", offset)
+	case opcode.OpBitNot:
+		return simpleInstruction(w, "OpBitNot", offset)
+	case opcode.OpShiftLeft:
+		return simpleInstruction(w, "OpShiftLeft", offset)
+	case opcode.OpShiftRight:
+		return simpleInstruction(w, "OpShiftRight", offset)
+	case opcode.OpBuildList:
+		return wordInstruction(w, "OpBuildList", chunk, offset)
+	case opcode.OpIndexGet:
+		return simpleInstruction(w, "OpIndexGet", offset)
+	case opcode.OpIndexSet:
+		return simpleInstruction(w, "OpIndexSet", offset)
+	case opcode.OpBuildMap:
+		return wordInstruction(w, "OpBuildMap", chunk, offset)
+	case opcode.OpToString:
+		return simpleInstruction(w, "OpToString", offset)
+	case opcode.OpThrow:
+		return simpleInstruction(w, "OpThrow", offset)
+	case opcode.OpPushCatch:
+		return jumpInstruction(w, "OpPushCatch", 1, chunk, offset)
+	case opcode.OpPushFinally:
+		return jumpInstruction(w, "OpPushFinally", 1, chunk, offset)
+	case opcode.OpPopHandler:
+		return simpleInstruction(w, "OpPopHandler", offset)
+	case opcode.OpEndFinally:
+		return simpleInstruction(w, "OpEndFinally", offset)
+	case opcode.OpImport:
+		return constantLongInstruction(w, "OpImport", chunk, offset)
+	case opcode.OpRange:
+		return simpleInstruction(w, "OpRange", offset)
+	case opcode.OpIterInit:
+		return simpleInstruction(w, "OpIterInit", offset)
+	case opcode.OpForIter:
+		return forIterInstruction(w, "OpForIter", chunk, offset)
+	case opcode.OpYield:
+		return simpleInstruction(w, "OpYield", offset)
+	case opcode.OpSpawn:
+		return byteInstruction(w, "OpSpawn", chunk, offset)
+	case opcode.OpSpawnInvoke:
+		return invokeInstruction(w, "OpSpawnInvoke", chunk, offset)
+	case opcode.OpSelect:
+		return byteInstruction(w, "OpSelect", chunk, offset)
+	case opcode.OpMatchList:
+		return wordInstruction(w, "OpMatchList", chunk, offset)
+	case opcode.OpMatchMap:
+		return simpleInstruction(w, "OpMatchMap", offset)
+	case opcode.OpMatchClass:
+		return simpleInstruction(w, "OpMatchClass", offset)
+	case opcode.OpMatchField:
+		return constantLongInstruction(w, "OpMatchField", chunk, offset)
+	case opcode.OpMatchRange:
+		return simpleInstruction(w, "OpMatchRange", offset)
+	case opcode.OpNoMatch:
+		return simpleInstruction(w, "OpNoMatch", offset)
 	default:
 		fmt.Fprintf(w, "Unknown opcode: %d\n", op)
 
@@ -57,16 +182,62 @@ func DisassembleStack(w io.Writer, stack []value.Value) {
 	fmt.Fprintf(w, "+---| ")
 
 	for _, val := range stack {
-		fmt.Fprintf(w, "[ %v ]", val)
+		fmt.Fprintf(w, "[ %v ]", formatValue(val))
 	}
 
 	fmt.Fprintln(w)
 }
 
+func byteInstruction(w io.Writer, name string, chunk *mem.Chunk, offset int) int {
+	operand := chunk.Read(offset + 1)
+
+	fmt.Fprintf(w, "%-16s %4d\n", name, operand)
+
+	return offset + 2
+}
+
+// closureInstruction prints a closure along with the variables it captures, naming each one
+// when the function carries the debug information to do so.
+func closureInstruction(w io.Writer, name string, chunk *mem.Chunk, offset int) int {
+	constantID := chunk.ReadWord(offset + 1)
+	constant := chunk.Constants[constantID]
+	offset += 3
+
+	fmt.Fprintf(w, "%-16s %4d %v", name, constantID, formatValue(constant))
+
+	function, _ := constant.AsObj().(*object.Function)
+	if function == nil || function.UpvalueCount == 0 {
+		fmt.Fprintln(w)
+
+		return offset
+	}
+
+	captures := make([]string, 0, function.UpvalueCount)
+
+	for i := 0; i < function.UpvalueCount; i++ {
+		kind := "upvalue"
+		if chunk.Read(offset) == 1 {
+			kind = "local"
+		}
+
+		capture := fmt.Sprintf("%s %d", kind, chunk.Read(offset+1))
+		if i < len(function.UpvalueNames) {
+			capture += fmt.Sprintf(" '%s'", function.UpvalueNames[i])
+		}
+
+		captures = append(captures, capture)
+		offset += 2
+	}
+
+	fmt.Fprintf(w, " [%s]\n", strings.Join(captures, ", "))
+
+	return offset
+}
+
 func constantInstruction(w io.Writer, name string, chunk *mem.Chunk, offset int) int {
 	constantID := chunk.Read(offset + 1)
 
-	fmt.Fprintf(w, "%-16s %4d '%v'\n", name, constantID, chunk.Constants[constantID])
+	fmt.Fprintf(w, "%-16s %4d %v\n", name, constantID, formatValue(chunk.Constants[constantID]))
 
 	return offset + 2
 }
@@ -74,13 +245,74 @@ func constantInstruction(w io.Writer, name string, chunk *mem.Chunk, offset int)
 func constantLongInstruction(w io.Writer, name string, chunk *mem.Chunk, offset int) int {
 	constantID := chunk.ReadWord(offset + 1)
 
-	fmt.Fprintf(w, "%-16s %4d '%v'\n", name, constantID, chunk.Constants[constantID])
+	fmt.Fprintf(w, "%-16s %4d %v\n", name, constantID, formatValue(chunk.Constants[constantID]))
 
 	return offset + 3
 }
 
+// jumpInstruction prints a jump along with its target offset. sign is -1 for jumps backwards.
+func jumpInstruction(w io.Writer, name string, sign int, chunk *mem.Chunk, offset int) int {
+	jump := int(chunk.ReadWord(offset + 1))
+
+	fmt.Fprintf(w, "%-16s %4d -> %d\n", name, offset, offset+3+sign*jump)
+
+	return offset + 3
+}
+
+// forIterInstruction prints the first hidden local of a for-in loop along with the jump taken
+// once the loop is done.
+func forIterInstruction(w io.Writer, name string, chunk *mem.Chunk, offset int) int {
+	slot := int(chunk.Read(offset + 1))
+	jump := int(chunk.ReadWord(offset + 2))
+
+	fmt.Fprintf(w, "%-16s %4d %4d -> %d\n", name, slot, offset, offset+4+jump)
+
+	return offset + 4
+}
+
+func localInstruction(w io.Writer, name string, chunk *mem.Chunk, offset int) int {
+	slot := int(chunk.Read(offset + 1))
+
+	if local, ok := chunk.LocalName(slot, offset); ok {
+		fmt.Fprintf(w, "%-16s %4d '%s'\n", name, slot, local)
+	} else {
+		fmt.Fprintf(w, "%-16s %4d\n", name, slot)
+	}
+
+	return offset + 2
+}
+
+func invokeInstruction(w io.Writer, name string, chunk *mem.Chunk, offset int) int {
+	constantID := chunk.ReadWord(offset + 1)
+	argCount := chunk.Read(offset + 3)
+
+	fmt.Fprintf(w, "%-16s (%d args) %4d %v\n", name, argCount, constantID, formatValue(chunk.Constants[constantID]))
+
+	return offset + 4
+}
+
 func simpleInstruction(w io.Writer, name string, offset int) int {
 	fmt.Fprintf(w, "%s\n", name)
 
 	return offset + 1
 }
+
+func wordInstruction(w io.Writer, name string, chunk *mem.Chunk, offset int) int {
+	operand := chunk.ReadWord(offset + 1)
+
+	fmt.Fprintf(w, "%-16s %4d\n", name, operand)
+
+	return offset + 3
+}
+
+// formatValue renders val for debug output, quoting strings so they can be told apart from
+// identifiers and other values.
+func formatValue(val value.Value) string {
+	if val.IsObj() {
+		if str, ok := val.AsObj().(*object.String); ok {
+			return strconv.Quote(str.Chars)
+		}
+	}
+
+	return val.String()
+}
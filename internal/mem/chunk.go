@@ -5,11 +5,26 @@ import (
 	"github.com/meanguy/automato/internal/value"
 )
 
-type Chunk struct {
-	Code      []uint8
-	Constants []value.Value
-	Lines     []int
-}
+type (
+	Chunk struct {
+		Code      []uint8
+		Constants []value.Value
+		Lines     []int
+		Locals    []LocalInfo
+	}
+
+	// LocalInfo is debug information naming the local variable held in Slot while the code in
+	// [Start, End) runs.
+	LocalInfo struct {
+		Name  string
+		Slot  int
+		Start int
+		End   int
+	}
+)
+
+// openLocal is the End of a LocalInfo whose scope hasn't been closed yet.
+const openLocal = -1
 
 func (c *Chunk) AddConstant(v value.Value) int {
 	c.Constants = append(c.Constants, v)
@@ -49,3 +64,31 @@ func (c *Chunk) WriteWord(w uint16, line int) {
 func (c *Chunk) WriteOp(op opcode.OpCode, line int) {
 	c.Write(uint8(op), line)
 }
+
+// BeginLocal records that the local name occupies slot from the code offset start onwards.
+func (c *Chunk) BeginLocal(name string, slot int, start int) {
+	c.Locals = append(c.Locals, LocalInfo{Name: name, Slot: slot, Start: start, End: openLocal})
+}
+
+// EndLocal closes the scope of the innermost open local in slot at the code offset end.
+func (c *Chunk) EndLocal(slot int, end int) {
+	for i := len(c.Locals) - 1; i >= 0; i-- {
+		if c.Locals[i].Slot == slot && c.Locals[i].End == openLocal {
+			c.Locals[i].End = end
+
+			return
+		}
+	}
+}
+
+// LocalName returns the name of the local held in slot at the code offset, if it's known.
+func (c *Chunk) LocalName(slot int, offset int) (string, bool) {
+	for i := len(c.Locals) - 1; i >= 0; i-- {
+		info := c.Locals[i]
+		if info.Slot == slot && info.Start <= offset && (info.End == openLocal || offset < info.End) {
+			return info.Name, true
+		}
+	}
+
+	return "", false
+}
@@ -14,7 +14,7 @@ import (
 func TestChunkAddAndGetConstant(t *testing.T) {
 	chunk := mem.Chunk{}
 
-	expected := value.Value(1.23)
+	expected := value.NewNumber(1.23)
 	actual := chunk.GetConstant(chunk.AddConstant(expected))
 
 	assert.Equal(t, expected, actual)
@@ -97,3 +97,36 @@ func TestChunkWriteAndReadOp(t *testing.T) {
 		})
 	}
 }
+
+func TestChunkLocalName(t *testing.T) {
+	chunk := mem.Chunk{}
+
+	chunk.BeginLocal("outer", 0, 2)
+	chunk.BeginLocal("inner", 1, 4)
+	chunk.EndLocal(1, 8)
+	chunk.BeginLocal("other", 1, 10)
+
+	testCases := []struct {
+		slot     int
+		offset   int
+		expected string
+		ok       bool
+	}{
+		{slot: 0, offset: 0, expected: "", ok: false},
+		{slot: 0, offset: 2, expected: "outer", ok: true},
+		{slot: 0, offset: 20, expected: "outer", ok: true},
+		{slot: 1, offset: 4, expected: "inner", ok: true},
+		{slot: 1, offset: 8, expected: "", ok: false},
+		{slot: 1, offset: 12, expected: "other", ok: true},
+		{slot: 2, offset: 12, expected: "", ok: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("slot=%d offset=%d", tc.slot, tc.offset), func(t *testing.T) {
+			actual, ok := chunk.LocalName(tc.slot, tc.offset)
+
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package object
+
+import (
+	"fmt"
+
+	"github.com/meanguy/automato/internal/value"
+)
+
+type (
+	Class struct {
+		Header
+
+		Name       *String
+		Methods    map[*String]value.Value
+		Superclass *Class
+	}
+
+	Instance struct {
+		Header
+
+		Class  *Class
+		Fields map[*String]value.Value
+	}
+
+	// BoundMethod is a method closure bound to the instance it was accessed on, which becomes
+	// 'this' when the method is called.
+	BoundMethod struct {
+		Header
+
+		Receiver value.Value
+		Method   *Closure
+	}
+)
+
+func NewClass(name *String) *Class {
+	return &Class{
+		Header:     Header{marked: false},
+		Name:       name,
+		Methods:    map[*String]value.Value{},
+		Superclass: nil,
+	}
+}
+
+func (c *Class) String() string {
+	return c.Name.Chars
+}
+
+func NewInstance(class *Class) *Instance {
+	return &Instance{
+		Header: Header{marked: false},
+		Class:  class,
+		Fields: map[*String]value.Value{},
+	}
+}
+
+func (i *Instance) String() string {
+	return fmt.Sprintf("<%s instance>", i.Class.Name.Chars)
+}
+
+func NewBoundMethod(receiver value.Value, method *Closure) *BoundMethod {
+	return &BoundMethod{
+		Header:   Header{marked: false},
+		Receiver: receiver,
+		Method:   method,
+	}
+}
+
+func (b *BoundMethod) String() string {
+	return b.Method.String()
+}
@@ -0,0 +1,57 @@
+package object
+
+import "github.com/meanguy/automato/internal/value"
+
+type (
+	// Closure is a Function paired with the variables it captured from enclosing scopes.
+	Closure struct {
+		Header
+
+		Function *Function
+		Upvalues []*Upvalue
+	}
+
+	// Upvalue is a variable captured by a closure. While the variable is still on the stack
+	// the upvalue is open and Location points at its stack slot, once the variable goes out of
+	// scope the upvalue is closed and Location points at Closed instead.
+	Upvalue struct {
+		Header
+
+		Location *value.Value
+		Closed   value.Value
+		Slot     int
+		Next     *Upvalue
+	}
+)
+
+func NewClosure(function *Function) *Closure {
+	return &Closure{
+		Header:   Header{marked: false},
+		Function: function,
+		Upvalues: make([]*Upvalue, function.UpvalueCount),
+	}
+}
+
+func (c *Closure) String() string {
+	return c.Function.String()
+}
+
+func NewUpvalue(location *value.Value, slot int) *Upvalue {
+	return &Upvalue{
+		Header:   Header{marked: false},
+		Location: location,
+		Closed:   value.NewNil(),
+		Slot:     slot,
+		Next:     nil,
+	}
+}
+
+// Close moves the captured variable off the stack and into the upvalue itself.
+func (u *Upvalue) Close() {
+	u.Closed = *u.Location
+	u.Location = &u.Closed
+}
+
+func (u *Upvalue) String() string {
+	return "upvalue"
+}
@@ -0,0 +1,51 @@
+package object
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/meanguy/automato/internal/mem"
+)
+
+// Function is a compiled function body. The top-level script is compiled to a Function with
+// no name, and anonymous functions are given a name in angle brackets saying where they're
+// defined, which no declared function can have. UpvalueNames is debug information naming
+// each variable the function captures, and Module holds the globals of the script the
+// function was compiled from. Calling a function that IsGenerator returns a generator running
+// the function instead.
+type Function struct {
+	Header
+
+	Arity        int
+	UpvalueCount int
+	UpvalueNames []string
+	Chunk        mem.Chunk
+	Name         *String
+	Module       *Module
+	IsGenerator  bool
+}
+
+func NewFunction() *Function {
+	return &Function{
+		Header:       Header{marked: false},
+		Arity:        0,
+		UpvalueCount: 0,
+		UpvalueNames: nil,
+		Chunk:        mem.Chunk{},
+		Name:         nil,
+		Module:       nil,
+		IsGenerator:  false,
+	}
+}
+
+func (f *Function) String() string {
+	if f.Name == nil {
+		return "<script>"
+	}
+
+	if strings.HasPrefix(f.Name.Chars, "<") {
+		return f.Name.Chars
+	}
+
+	return fmt.Sprintf("<fn %s>", f.Name.Chars)
+}
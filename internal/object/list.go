@@ -0,0 +1,29 @@
+package object
+
+import (
+	"strings"
+
+	"github.com/meanguy/automato/internal/value"
+)
+
+// List is a growable, ordered sequence of values. Version must be bumped whenever elements are
+// added or removed, so iterators can tell the list changed under them.
+type List struct {
+	Header
+
+	Elements []value.Value
+	Version  int
+}
+
+func NewList(elements []value.Value) *List {
+	return &List{Header: Header{marked: false}, Elements: elements, Version: 0}
+}
+
+func (l *List) String() string {
+	elements := make([]string, 0, len(l.Elements))
+	for _, element := range l.Elements {
+		elements = append(elements, element.String())
+	}
+
+	return "[" + strings.Join(elements, ", ") + "]"
+}
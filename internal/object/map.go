@@ -0,0 +1,125 @@
+package object
+
+import (
+	"math"
+	"strings"
+
+	"github.com/meanguy/automato/internal/value"
+)
+
+type (
+	// Map is a hash map from strings, numbers, booleans or nil to values that remembers the
+	// order its keys were inserted in.
+	Map struct {
+		Header
+
+		entries []MapEntry
+		index   map[value.Value]int
+		version int
+	}
+
+	MapEntry struct {
+		Key   value.Value
+		Value value.Value
+	}
+)
+
+func NewMap() *Map {
+	return &Map{
+		Header:  Header{marked: false},
+		entries: nil,
+		index:   map[value.Value]int{},
+		version: 0,
+	}
+}
+
+// IsHashable reports whether key can be used as a map key.
+func IsHashable(key value.Value) bool {
+	switch key.Type {
+	case value.Bool, value.Nil, value.Int, value.Number:
+		return true
+	case value.Object:
+		_, ok := key.AsObj().(*String)
+
+		return ok
+	default:
+		return false
+	}
+}
+
+// Get returns the value stored under key.
+func (m *Map) Get(key value.Value) (value.Value, bool) {
+	i, ok := m.index[hashKey(key)]
+	if !ok {
+		return value.NewNil(), false
+	}
+
+	return m.entries[i].Value, true
+}
+
+// Set stores val under key. New keys are ordered after every existing key, overwriting a key
+// keeps its position.
+func (m *Map) Set(key value.Value, val value.Value) {
+	if i, ok := m.index[hashKey(key)]; ok {
+		m.entries[i].Value = val
+
+		return
+	}
+
+	m.index[hashKey(key)] = len(m.entries)
+	m.entries = append(m.entries, MapEntry{Key: key, Value: val})
+	m.version++
+}
+
+// Delete removes key from m, reporting whether it was present.
+func (m *Map) Delete(key value.Value) bool {
+	i, ok := m.index[hashKey(key)]
+	if !ok {
+		return false
+	}
+
+	delete(m.index, hashKey(key))
+	m.entries = append(m.entries[:i], m.entries[i+1:]...)
+	m.version++
+
+	for ; i < len(m.entries); i++ {
+		m.index[hashKey(m.entries[i].Key)] = i
+	}
+
+	return true
+}
+
+// Version changes whenever a key is added to or removed from m, so iterators can tell the map
+// changed under them. Overwriting the value of a key leaves it as is.
+func (m *Map) Version() int {
+	return m.version
+}
+
+func (m *Map) Len() int {
+	return len(m.entries)
+}
+
+// Entries returns the entries of m in insertion order. The slice must not be modified.
+func (m *Map) Entries() []MapEntry {
+	return m.entries
+}
+
+func (m *Map) String() string {
+	entries := make([]string, 0, len(m.entries))
+	for _, entry := range m.entries {
+		entries = append(entries, entry.Key.String()+": "+entry.Value.String())
+	}
+
+	return "{" + strings.Join(entries, ", ") + "}"
+}
+
+// hashKey normalizes key so that equal numbers hash the same, whether they're ints or floats.
+func hashKey(key value.Value) value.Value {
+	if key.IsNumber() {
+		if f := key.AsNumber(); f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+			return value.NewInt(int64(f))
+		}
+	}
+
+	return key
+}
@@ -0,0 +1,46 @@
+package object
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/meanguy/automato/internal/value"
+)
+
+// Module is the global scope of a script. Every function compiled from the script reads and
+// writes its globals through the module. Path is empty for scripts that weren't loaded from a
+// file.
+type Module struct {
+	Header
+
+	Path    string
+	Globals map[*String]value.Value
+}
+
+func NewModule(path string) *Module {
+	return &Module{
+		Header:  Header{marked: false},
+		Path:    path,
+		Globals: map[*String]value.Value{},
+	}
+}
+
+// Export returns the global called name if m exports it. Globals whose name starts with an
+// underscore are private to the module.
+func (m *Module) Export(name *String) (value.Value, bool) {
+	if strings.HasPrefix(name.Chars, "_") {
+		return value.NewNil(), false
+	}
+
+	val, ok := m.Globals[name]
+
+	return val, ok
+}
+
+func (m *Module) String() string {
+	if m.Path == "" {
+		return "<module>"
+	}
+
+	return fmt.Sprintf("<module %s>", m.Path)
+}
@@ -0,0 +1,41 @@
+package object
+
+import (
+	"fmt"
+
+	"github.com/meanguy/automato/internal/value"
+)
+
+type (
+	// NativeFn is a Go function callable from scripts. args aliases the VM's stack and is only
+	// valid until the function returns.
+	NativeFn func(args []value.Value) (value.Value, error)
+
+	// Native is a Go function exposed to scripts. A negative Arity accepts any number of
+	// arguments.
+	Native struct {
+		Header
+
+		Name  string
+		Arity int
+		Fn    NativeFn
+	}
+)
+
+func NewNative(name string, arity int, fn NativeFn) *Native {
+	return &Native{
+		Header: Header{marked: false},
+		Name:   name,
+		Arity:  arity,
+		Fn:     fn,
+	}
+}
+
+// IsVariadic reports whether n accepts any number of arguments.
+func (n *Native) IsVariadic() bool {
+	return n.Arity < 0
+}
+
+func (n *Native) String() string {
+	return fmt.Sprintf("<native fn %s>", n.Name)
+}
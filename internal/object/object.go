@@ -0,0 +1,26 @@
+package object
+
+import "github.com/meanguy/automato/internal/value"
+
+type (
+	// Obj is a heap object managed by the VM's garbage collector.
+	Obj interface {
+		value.Obj
+
+		IsMarked() bool
+		SetMarked(marked bool)
+	}
+
+	// Header is embedded in every heap object and holds the garbage collector's bookkeeping.
+	Header struct {
+		marked bool
+	}
+)
+
+func (h *Header) IsMarked() bool {
+	return h.marked
+}
+
+func (h *Header) SetMarked(marked bool) {
+	h.marked = marked
+}
@@ -0,0 +1,19 @@
+package object
+
+import "fmt"
+
+// Range is the half-open sequence of integers from Start up to but not including End.
+type Range struct {
+	Header
+
+	Start int64
+	End   int64
+}
+
+func NewRange(start, end int64) *Range {
+	return &Range{Header: Header{marked: false}, Start: start, End: end}
+}
+
+func (r *Range) String() string {
+	return fmt.Sprintf("%d..%d", r.Start, r.End)
+}
@@ -0,0 +1,17 @@
+package object
+
+// String is an immutable, heap-allocated string. Strings are interned by the VM so two
+// strings with the same characters are always the same *String.
+type String struct {
+	Header
+
+	Chars string
+}
+
+func NewString(chars string) *String {
+	return &String{Header: Header{marked: false}, Chars: chars}
+}
+
+func (s *String) String() string {
+	return s.Chars
+}
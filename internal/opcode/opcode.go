@@ -6,9 +6,70 @@ const (
 	OpReturn OpCode = iota + 1
 	OpConstant
 	OpConstantLong
+	OpNil
+	OpTrue
+	OpFalse
 	OpNegate
+	OpNot
+	OpEqual
+	OpGreater
+	OpLess
 	OpAdd
 	OpSubtract
 	OpMultiply
 	OpDivide
+	OpPrint
+	OpPop
+	OpDefineGlobal
+	OpGetGlobal
+	OpSetGlobal
+	OpGetLocal
+	OpSetLocal
+	OpJump
+	OpJumpIfFalse
+	OpLoop
+	OpCall
+	OpClosure
+	OpGetUpvalue
+	OpSetUpvalue
+	OpCloseUpvalue
+	OpClass
+	OpMethod
+	OpGetProperty
+	OpSetProperty
+	OpInvoke
+	OpInherit
+	OpGetSuper
+	OpSuperInvoke
+	OpModulo
+	OpBitAnd
+	OpBitOr
+	OpBitXor
+	OpBitNot
+	OpShiftLeft
+	OpShiftRight
+	OpBuildList
+	OpIndexGet
+	OpIndexSet
+	OpBuildMap
+	OpToString
+	OpThrow
+	OpPushCatch
+	OpPushFinally
+	OpPopHandler
+	OpEndFinally
+	OpImport
+	OpRange
+	OpIterInit
+	OpForIter
+	OpYield
+	OpSpawn
+	OpSpawnInvoke
+	OpSelect
+	OpMatchList
+	OpMatchMap
+	OpMatchClass
+	OpMatchField
+	OpMatchRange
+	OpNoMatch
 )
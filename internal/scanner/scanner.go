@@ -1,36 +1,73 @@
 package scanner
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
 
 	"github.com/meanguy/automato/internal/scanner/token"
 )
 
-type Scanner struct {
-	Source []byte
-	Cursor int
-	Start  int
-	Line   int
-}
+type (
+	// Scanner splits source code into tokens. Cursor and Start are offsets into Source, counted
+	// in runes.
+	Scanner struct {
+		Source []rune
+		Cursor int
+		Start  int
+		Line   int
+
+		// interpolations tracks the string interpolations the scanner is inside of, innermost
+		// last.
+		interpolations []interpolation
+	}
+
+	// interpolation is an expression embedded in a string literal with "${...}".
+	interpolation struct {
+		// braces counts the unclosed '{' inside the expression, so the scanner can tell the
+		// '}' that ends the expression apart from ones belonging to it.
+		braces int
+		line   int
+	}
+)
 
 func NewScanner(source string) *Scanner {
 	return &Scanner{
-		Source: []byte(source),
+		Source: []rune(source),
 		Cursor: 0,
 		Start:  0,
 		Line:   1,
+
+		interpolations: nil,
 	}
 }
 
+// Clone returns a copy of s that scans independently of it, so callers can look ahead without
+// consuming tokens.
+func (s *Scanner) Clone() *Scanner {
+	clone := *s
+	clone.interpolations = append([]interpolation(nil), s.interpolations...)
+
+	return &clone
+}
+
 //nolint:cyclop // token parsing and scanning has a high degree of branching
 // by design -- actual complexity should be hidden in helper methods.
 func (s *Scanner) ScanToken() token.Token {
 	s.skipWhitespace()
-	s.skipComments()
 
 	s.Start = s.Cursor
 
 	if s.isAtEnd() {
+		if len(s.interpolations) > 0 {
+			line := s.interpolations[0].line
+			s.interpolations = nil
+
+			return token.Token{Type: token.Error, Str: "unterminated string interpolation", Line: line}
+		}
+
 		return s.makeToken(token.EOF)
 	}
 
@@ -50,14 +87,39 @@ func (s *Scanner) ScanToken() token.Token {
 	case ')':
 		return s.makeToken(token.RightParen)
 	case '{':
+		if len(s.interpolations) > 0 {
+			s.interpolations[len(s.interpolations)-1].braces++
+		}
+
 		return s.makeToken(token.LeftBrace)
 	case '}':
+		if len(s.interpolations) > 0 {
+			current := &s.interpolations[len(s.interpolations)-1]
+			if current.braces == 0 {
+				s.interpolations = s.interpolations[:len(s.interpolations)-1]
+
+				return s.makeStringLiteralToken()
+			}
+
+			current.braces--
+		}
+
 		return s.makeToken(token.RightBrace)
+	case '[':
+		return s.makeToken(token.LeftBracket)
+	case ']':
+		return s.makeToken(token.RightBracket)
+	case ':':
+		return s.makeToken(token.Colon)
 	case ';':
 		return s.makeToken(token.Semicolon)
 	case ',':
 		return s.makeToken(token.Comma)
 	case '.':
+		if s.match('.') {
+			return s.makeToken(token.DotDot)
+		}
+
 		return s.makeToken(token.Dot)
 	case '-':
 		return s.makeToken(token.Minus)
@@ -69,6 +131,14 @@ func (s *Scanner) ScanToken() token.Token {
 		return s.makeToken(token.Star)
 	case '%':
 		return s.makeToken(token.Percent)
+	case '&':
+		return s.makeToken(token.Ampersand)
+	case '|':
+		return s.makeToken(token.Pipe)
+	case '^':
+		return s.makeToken(token.Caret)
+	case '~':
+		return s.makeToken(token.Tilde)
 	case '!':
 		if s.match('=') {
 			return s.makeToken(token.BangEqual)
@@ -76,21 +146,30 @@ func (s *Scanner) ScanToken() token.Token {
 			return s.makeToken(token.Bang)
 		}
 	case '=':
-		if s.match('=') {
+		switch {
+		case s.match('='):
 			return s.makeToken(token.EqualEqual)
-		} else {
+		case s.match('>'):
+			return s.makeToken(token.EqualGreater)
+		default:
 			return s.makeToken(token.Equal)
 		}
 	case '<':
-		if s.match('=') {
+		switch {
+		case s.match('='):
 			return s.makeToken(token.LessEqual)
-		} else {
+		case s.match('<'):
+			return s.makeToken(token.LessLess)
+		default:
 			return s.makeToken(token.Less)
 		}
 	case '>':
-		if s.match('=') {
+		switch {
+		case s.match('='):
 			return s.makeToken(token.GreaterEqual)
-		} else {
+		case s.match('>'):
+			return s.makeToken(token.GreaterGreater)
+		default:
 			return s.makeToken(token.Greater)
 		}
 	case '"':
@@ -100,27 +179,25 @@ func (s *Scanner) ScanToken() token.Token {
 	return s.makeErrorTokenf("unexpected character '%v'", string(char))
 }
 
-func (s *Scanner) advance() byte {
+func (s *Scanner) advance() rune {
 	s.Cursor++
 
 	return s.Source[s.Cursor-1]
 }
 
-func (s *Scanner) isAlpha(char byte) bool {
-	return ('a' <= char && char <= 'z') ||
-		('A' <= char && char <= 'Z') ||
-		(char == '_')
+func (s *Scanner) isAlpha(char rune) bool {
+	return unicode.IsLetter(char) || char == '_'
 }
 
 func (s *Scanner) isAtEnd() bool {
 	return len(s.Source) <= s.Cursor
 }
 
-func (s *Scanner) isDigit(char byte) bool {
+func (s *Scanner) isDigit(char rune) bool {
 	return '0' <= char && char <= '9'
 }
 
-func (s *Scanner) match(char byte) bool {
+func (s *Scanner) match(char rune) bool {
 	if s.isAtEnd() {
 		return false
 	}
@@ -135,6 +212,10 @@ func (s *Scanner) match(char byte) bool {
 }
 
 func (s *Scanner) checkKeyword(start int, prefix string, tokenType token.TokenType) token.TokenType {
+	if s.Cursor-s.Start != start+len(prefix) {
+		return token.Identifier
+	}
+
 	offset := s.Start + start
 	slice := string(s.Source[offset : offset+len(prefix)])
 	if slice == prefix {
@@ -148,13 +229,38 @@ func (s *Scanner) checkKeyword(start int, prefix string, tokenType token.TokenTy
 func (s *Scanner) identifierType() token.TokenType {
 	switch s.Source[s.Start] {
 	case 'a':
-		return s.checkKeyword(1, "nd", token.And)
+		if s.Cursor-s.Start > 1 {
+			switch s.Source[s.Start+1] {
+			case 'n':
+				return s.checkKeyword(2, "d", token.And)
+			case 's':
+				return s.checkKeyword(2, "", token.As)
+			}
+		}
 	case 'c':
-		return s.checkKeyword(1, "lass", token.Class)
+		if s.Cursor-s.Start > 1 {
+			switch s.Source[s.Start+1] {
+			case 'a':
+				return s.checkKeyword(2, "tch", token.Catch)
+			case 'l':
+				return s.checkKeyword(2, "ass", token.Class)
+			}
+		}
 	case 'e':
 		return s.checkKeyword(1, "lse", token.Else)
 	case 'i':
-		return s.checkKeyword(1, "f", token.If)
+		if s.Cursor-s.Start > 1 {
+			switch s.Source[s.Start+1] {
+			case 'f':
+				return s.checkKeyword(2, "", token.If)
+			case 'm':
+				return s.checkKeyword(2, "port", token.Import)
+			case 'n':
+				return s.checkKeyword(2, "", token.In)
+			}
+		}
+	case 'm':
+		return s.checkKeyword(1, "atch", token.Match)
 	case 'n':
 		return s.checkKeyword(1, "il", token.Nil)
 	case 'o':
@@ -164,16 +270,29 @@ func (s *Scanner) identifierType() token.TokenType {
 	case 'r':
 		return s.checkKeyword(1, "eturn", token.Return)
 	case 's':
-		return s.checkKeyword(1, "uper", token.Super)
+		if s.Cursor-s.Start > 1 {
+			switch s.Source[s.Start+1] {
+			case 'e':
+				return s.checkKeyword(2, "lect", token.Select)
+			case 'p':
+				return s.checkKeyword(2, "awn", token.Spawn)
+			case 'u':
+				return s.checkKeyword(2, "per", token.Super)
+			}
+		}
 	case 'v':
 		return s.checkKeyword(1, "ar", token.Var)
 	case 'w':
 		return s.checkKeyword(1, "hile", token.While)
+	case 'y':
+		return s.checkKeyword(1, "ield", token.Yield)
 	case 'f':
-		if len(s.Source) > 1 {
+		if s.Cursor-s.Start > 1 {
 			switch s.Source[s.Start+1] {
 			case 'a':
 				return s.checkKeyword(2, "lse", token.False)
+			case 'i':
+				return s.checkKeyword(2, "nally", token.Finally)
 			case 'o':
 				return s.checkKeyword(2, "r", token.For)
 			case 'u':
@@ -181,11 +300,19 @@ func (s *Scanner) identifierType() token.TokenType {
 			}
 		}
 	case 't':
-		if len(s.Source) > 1 {
+		if s.Cursor-s.Start > 1 {
 			switch s.Source[s.Start+1] {
 			case 'h':
+				if s.Cursor-s.Start > 2 && s.Source[s.Start+2] == 'r' {
+					return s.checkKeyword(3, "ow", token.Throw)
+				}
+
 				return s.checkKeyword(2, "is", token.This)
 			case 'r':
+				if s.Cursor-s.Start > 2 && s.Source[s.Start+2] == 'y' {
+					return s.checkKeyword(3, "", token.Try)
+				}
+
 				return s.checkKeyword(2, "ue", token.True)
 			}
 		}
@@ -196,9 +323,10 @@ func (s *Scanner) identifierType() token.TokenType {
 
 func (s *Scanner) makeErrorTokenf(msg string, args ...any) token.Token {
 	return token.Token{
-		Type: token.Error,
-		Str:  fmt.Sprintf(msg, args...),
-		Line: s.Line,
+		Type:    token.Error,
+		Str:     fmt.Sprintf(msg, args...),
+		Line:    s.Line,
+		Literal: "",
 	}
 }
 
@@ -226,33 +354,134 @@ func (s *Scanner) makeNumberLiteralToken() token.Token {
 	return s.makeToken(token.Number)
 }
 
+// makeStringLiteralToken scans the rest of a string literal, or of its segment up to the next
+// embedded expression, decoding escape sequences along the way. An invalid escape sequence is
+// reported once the whole segment has been scanned, so scanning resumes after the string.
 func (s *Scanner) makeStringLiteralToken() token.Token {
+	var (
+		literal strings.Builder
+		invalid *token.Token
+	)
+
+	line := s.Line
+
 	for s.peek() != '"' && !s.isAtEnd() {
-		if s.peek() == '\n' {
-			s.Line++
-		}
+		char := s.advance()
 
-		_ = s.advance()
+		switch {
+		case char == '$' && s.peek() == '{':
+			_ = s.advance()
+
+			s.interpolations = append(s.interpolations, interpolation{braces: 0, line: s.Line})
+
+			return s.makeLiteralToken(token.Interpolation, literal.String(), invalid)
+		case char == '\\':
+			decoded, err := s.escapeSequence()
+			if err != nil && invalid == nil {
+				errorToken := s.makeErrorTokenf("%s", err.Error())
+				invalid = &errorToken
+			}
+
+			literal.WriteRune(decoded)
+		default:
+			if char == '\n' {
+				s.Line++
+			}
+
+			literal.WriteRune(char)
+		}
 	}
 
 	if s.isAtEnd() {
-		return s.makeErrorTokenf("unterminated string")
+		s.interpolations = nil
+
+		return token.Token{Type: token.Error, Str: "unterminated string", Line: line, Literal: ""}
 	}
 
 	_ = s.advance()
 
-	return s.makeToken(token.String)
+	return s.makeLiteralToken(token.String, literal.String(), invalid)
+}
+
+// escapeSequence decodes the escape sequence following a backslash.
+func (s *Scanner) escapeSequence() (rune, error) {
+	// a newline is left for the caller to consume, so it's counted.
+	if s.isAtEnd() || s.peek() == '\n' {
+		return 0, errors.New("invalid escape sequence '\\' at end of line")
+	}
+
+	switch char := s.advance(); char {
+	case 'n':
+		return '\n', nil
+	case 'r':
+		return '\r', nil
+	case 't':
+		return '\t', nil
+	case '0':
+		return 0, nil
+	case '"', '\\', '$':
+		return char, nil
+	case 'u':
+		return s.unicodeEscape()
+	default:
+		return 0, fmt.Errorf("invalid escape sequence '\\%c'", char)
+	}
+}
+
+// unicodeEscape decodes the code point of a '\u{...}' escape, written as 1 to 6 hex digits.
+func (s *Scanner) unicodeEscape() (rune, error) {
+	if !s.match('{') {
+		return 0, errors.New("expect '{' after '\\u'")
+	}
+
+	start := s.Cursor
+	for s.peek() != '}' && s.peek() != '"' && s.peek() != '\n' && !s.isAtEnd() {
+		_ = s.advance()
+	}
+
+	digits := string(s.Source[start:s.Cursor])
+
+	if !s.match('}') {
+		return 0, fmt.Errorf("unterminated unicode escape '\\u{%s'", digits)
+	}
+
+	const maxHexDigits = 6
+
+	code, err := strconv.ParseUint(digits, 16, 32)
+	if err != nil || len(digits) > maxHexDigits {
+		return 0, fmt.Errorf("invalid unicode escape '\\u{%s}'", digits)
+	}
+
+	if code > unicode.MaxRune || (0xD800 <= code && code <= 0xDFFF) {
+		return 0, fmt.Errorf("invalid code point '\\u{%s}'", digits)
+	}
+
+	return rune(code), nil
 }
 
 func (s *Scanner) makeToken(tokenType token.TokenType) token.Token {
 	return token.Token{
-		Type: tokenType,
-		Str:  string(s.Source[s.Start:s.Cursor]),
-		Line: s.Line,
+		Type:    tokenType,
+		Str:     string(s.Source[s.Start:s.Cursor]),
+		Line:    s.Line,
+		Literal: "",
+	}
+}
+
+// makeLiteralToken makes a String or Interpolation token holding literal, unless an invalid
+// escape sequence was found while scanning it.
+func (s *Scanner) makeLiteralToken(tokenType token.TokenType, literal string, invalid *token.Token) token.Token {
+	if invalid != nil {
+		return *invalid
 	}
+
+	tok := s.makeToken(tokenType)
+	tok.Literal = literal
+
+	return tok
 }
 
-func (s *Scanner) peek() byte {
+func (s *Scanner) peek() rune {
 	if s.isAtEnd() {
 		return 0
 	}
@@ -260,7 +489,7 @@ func (s *Scanner) peek() byte {
 	return s.Source[s.Cursor]
 }
 
-func (s *Scanner) peekNext() byte {
+func (s *Scanner) peekNext() rune {
 	if s.Cursor >= len(s.Source)-1 {
 		return 0
 	}
@@ -268,24 +497,6 @@ func (s *Scanner) peekNext() byte {
 	return s.Source[s.Cursor+1]
 }
 
-func (s *Scanner) skipComments() {
-	for {
-		char := s.peek()
-		switch char {
-		case '/':
-			if s.peekNext() == '/' {
-				for s.peek() != '\n' && !s.isAtEnd() {
-					_ = s.advance()
-				}
-			} else {
-				return
-			}
-		default:
-			return
-		}
-	}
-}
-
 func (s *Scanner) skipWhitespace() {
 	for {
 		char := s.peek()
@@ -299,6 +510,14 @@ func (s *Scanner) skipWhitespace() {
 		case '\n':
 			s.Line++
 			_ = s.advance()
+		case '/':
+			if s.peekNext() != '/' {
+				return
+			}
+
+			for s.peek() != '\n' && !s.isAtEnd() {
+				_ = s.advance()
+			}
 		default:
 			return
 		}
@@ -21,7 +21,8 @@ func TestScanToken(t *testing.T) {
 		{"   \t", token.EOF},
 		{"\nfoo", token.Identifier},
 		{`"nonterminating`, token.Error},
-		{`....`, token.Dot},
+		{`.`, token.Dot},
+		{`....`, token.DotDot},
 		{`"foo"`, token.String},
 		{`"foo" + "bar"`, token.String},
 		{"200", token.Number},
@@ -30,6 +31,41 @@ func TestScanToken(t *testing.T) {
 		{"false", token.False},
 		{"super", token.Super},
 		{"return", token.Return},
+		{"a", token.Identifier},
+		{"andy", token.Identifier},
+		{"fo", token.Identifier},
+		{"t", token.Identifier},
+		{"throw", token.Throw},
+		{"thro", token.Identifier},
+		{"this", token.This},
+		{"try", token.Try},
+		{"tr", token.Identifier},
+		{"tryout", token.Identifier},
+		{"true", token.True},
+		{"catch", token.Catch},
+		{"class", token.Class},
+		{"c", token.Identifier},
+		{"finally", token.Finally},
+		{"as", token.As},
+		{"and", token.And},
+		{"a", token.Identifier},
+		{"ask", token.Identifier},
+		{"import", token.Import},
+		{"in", token.In},
+		{"yield", token.Yield},
+		{"yielded", token.Identifier},
+		{"select", token.Select},
+		{"spawn", token.Spawn},
+		{"s", token.Identifier},
+		{"spawned", token.Identifier},
+		{"match", token.Match},
+		{"matches", token.Identifier},
+		{"=>", token.EqualGreater},
+		{"inside", token.Identifier},
+		{"if", token.If},
+		{"i", token.Identifier},
+		{"imp", token.Identifier},
+		{"final", token.Identifier},
 		{"(", token.LeftParen},
 		{";", token.Semicolon},
 		{"/", token.Slash},
@@ -38,6 +74,17 @@ func TestScanToken(t *testing.T) {
 		{"=", token.Equal},
 		{"==", token.EqualEqual},
 		{">=", token.GreaterEqual},
+		{"[", token.LeftBracket},
+		{"]", token.RightBracket},
+		{":", token.Colon},
+		{"%", token.Percent},
+		{"&", token.Ampersand},
+		{"|", token.Pipe},
+		{"^", token.Caret},
+		{"~", token.Tilde},
+		{"<<", token.LessLess},
+		{">>", token.GreaterGreater},
+		{"..", token.DotDot},
 	}
 
 	for index, tc := range testCases {
@@ -86,7 +133,7 @@ func TestScanTokenMultipleTokens(t *testing.T) {
 				{Type: token.RightParen, Line: 1, Str: ")"},
 				{Type: token.LeftBrace, Line: 1, Str: "{"},
 				{Type: token.Return, Line: 2, Str: "return"},
-				{Type: token.String, Line: 2, Str: "\"hello\""},
+				{Type: token.String, Line: 2, Str: "\"hello\"", Literal: "hello"},
 				{Type: token.RightBrace, Line: 3, Str: "}"},
 			},
 		},
@@ -95,9 +142,9 @@ func TestScanTokenMultipleTokens(t *testing.T) {
 			expected: []token.Token{
 				{Type: token.Print, Line: 1, Str: "print"},
 				{Type: token.LeftParen, Line: 1, Str: "("},
-				{Type: token.String, Line: 1, Str: "\"hello\""},
+				{Type: token.String, Line: 1, Str: "\"hello\"", Literal: "hello"},
 				{Type: token.Comma, Line: 1, Str: ","},
-				{Type: token.String, Line: 1, Str: "\"world\""},
+				{Type: token.String, Line: 1, Str: "\"world\"", Literal: "world"},
 				{Type: token.RightParen, Line: 1, Str: ")"},
 			},
 		},
@@ -160,6 +207,23 @@ func TestScanTokenMultipleTokens(t *testing.T) {
 				{Type: token.RightBrace, Line: 4, Str: "}"},
 			},
 		},
+		{
+			text: "for (i in 1..n.len())",
+			expected: []token.Token{
+				{Type: token.For, Line: 1, Str: "for"},
+				{Type: token.LeftParen, Line: 1, Str: "("},
+				{Type: token.Identifier, Line: 1, Str: "i"},
+				{Type: token.In, Line: 1, Str: "in"},
+				{Type: token.Number, Line: 1, Str: "1"},
+				{Type: token.DotDot, Line: 1, Str: ".."},
+				{Type: token.Identifier, Line: 1, Str: "n"},
+				{Type: token.Dot, Line: 1, Str: "."},
+				{Type: token.Identifier, Line: 1, Str: "len"},
+				{Type: token.LeftParen, Line: 1, Str: "("},
+				{Type: token.RightParen, Line: 1, Str: ")"},
+				{Type: token.RightParen, Line: 1, Str: ")"},
+			},
+		},
 		{
 			text: "class Foo {}",
 			expected: []token.Token{
@@ -220,6 +284,25 @@ func TestScanTokenMultipleTokens(t *testing.T) {
 				{Type: token.RightBrace, Line: 1, Str: "}"},
 			},
 		},
+		{
+			text: "a<<2>>b<=c",
+			expected: []token.Token{
+				{Type: token.Identifier, Line: 1, Str: "a"},
+				{Type: token.LessLess, Line: 1, Str: "<<"},
+				{Type: token.Number, Line: 1, Str: "2"},
+				{Type: token.GreaterGreater, Line: 1, Str: ">>"},
+				{Type: token.Identifier, Line: 1, Str: "b"},
+				{Type: token.LessEqual, Line: 1, Str: "<="},
+				{Type: token.Identifier, Line: 1, Str: "c"},
+			},
+		},
+		{
+			text: "x t",
+			expected: []token.Token{
+				{Type: token.Identifier, Line: 1, Str: "x"},
+				{Type: token.Identifier, Line: 1, Str: "t"},
+			},
+		},
 		{
 			text: "$",
 			expected: []token.Token{
@@ -229,7 +312,59 @@ func TestScanTokenMultipleTokens(t *testing.T) {
 		{
 			text: "\"multiline\nstring\"",
 			expected: []token.Token{
-				{Type: token.String, Line: 2, Str: "\"multiline\nstring\""},
+				{Type: token.String, Line: 2, Str: "\"multiline\nstring\"", Literal: "multiline\nstring"},
+			},
+		},
+		{
+			text: `"deploy ${service} to ${env}"`,
+			expected: []token.Token{
+				{Type: token.Interpolation, Line: 1, Str: `"deploy ${`, Literal: "deploy "},
+				{Type: token.Identifier, Line: 1, Str: "service"},
+				{Type: token.Interpolation, Line: 1, Str: "} to ${", Literal: " to "},
+				{Type: token.Identifier, Line: 1, Str: "env"},
+				{Type: token.String, Line: 1, Str: `}"`, Literal: ""},
+				{Type: token.EOF, Line: 1, Str: ""},
+			},
+		},
+		{
+			text: `"a ${ {"k": "${b}"}["k"] } c"`,
+			expected: []token.Token{
+				{Type: token.Interpolation, Line: 1, Str: `"a ${`, Literal: "a "},
+				{Type: token.LeftBrace, Line: 1, Str: "{"},
+				{Type: token.String, Line: 1, Str: `"k"`, Literal: "k"},
+				{Type: token.Colon, Line: 1, Str: ":"},
+				{Type: token.Interpolation, Line: 1, Str: `"${`, Literal: ""},
+				{Type: token.Identifier, Line: 1, Str: "b"},
+				{Type: token.String, Line: 1, Str: `}"`, Literal: ""},
+				{Type: token.RightBrace, Line: 1, Str: "}"},
+				{Type: token.LeftBracket, Line: 1, Str: "["},
+				{Type: token.String, Line: 1, Str: `"k"`, Literal: "k"},
+				{Type: token.RightBracket, Line: 1, Str: "]"},
+				{Type: token.String, Line: 1, Str: `} c"`, Literal: " c"},
+			},
+		},
+		{
+			text: "\"$ and {} are text\"",
+			expected: []token.Token{
+				{Type: token.String, Line: 1, Str: "\"$ and {} are text\"", Literal: "$ and {} are text"},
+			},
+		},
+		{
+			text: "\n\"a ${\nb\n\n",
+			expected: []token.Token{
+				{Type: token.Interpolation, Line: 2, Str: "\"a ${", Literal: "a "},
+				{Type: token.Identifier, Line: 3, Str: "b"},
+				{Type: token.Error, Line: 2, Str: "unterminated string interpolation"},
+				{Type: token.EOF, Line: 5, Str: ""},
+			},
+		},
+		{
+			text: "\"a\n${b}\nc",
+			expected: []token.Token{
+				{Type: token.Interpolation, Line: 2, Str: "\"a\n${", Literal: "a\n"},
+				{Type: token.Identifier, Line: 2, Str: "b"},
+				{Type: token.Error, Line: 2, Str: "unterminated string"},
+				{Type: token.EOF, Line: 3, Str: ""},
 			},
 		},
 	}
@@ -250,3 +385,130 @@ func TestScanTokenMultipleTokens(t *testing.T) {
 		})
 	}
 }
+
+func TestScanTokenStringEscapes(t *testing.T) {
+	testCases := []struct {
+		text     string
+		expected token.Token
+	}{
+		{`"a\nb"`, token.Token{Type: token.String, Line: 1, Str: `"a\nb"`, Literal: "a\nb"}},
+		{`"a\rb"`, token.Token{Type: token.String, Line: 1, Str: `"a\rb"`, Literal: "a\rb"}},
+		{`"a\tb"`, token.Token{Type: token.String, Line: 1, Str: `"a\tb"`, Literal: "a\tb"}},
+		{`"a\0b"`, token.Token{Type: token.String, Line: 1, Str: `"a\0b"`, Literal: "a\x00b"}},
+		{`"say \"hi\""`, token.Token{Type: token.String, Line: 1, Str: `"say \"hi\""`, Literal: `say "hi"`}},
+		{`"C:\\tmp"`, token.Token{Type: token.String, Line: 1, Str: `"C:\\tmp"`, Literal: `C:\tmp`}},
+		{`"\${x}"`, token.Token{Type: token.String, Line: 1, Str: `"\${x}"`, Literal: "${x}"}},
+		{`"\u{41}"`, token.Token{Type: token.String, Line: 1, Str: `"\u{41}"`, Literal: "A"}},
+		{`"\u{e9}t\u{E9}"`, token.Token{Type: token.String, Line: 1, Str: `"\u{e9}t\u{E9}"`, Literal: "été"}},
+		{`"\u{1F345}"`, token.Token{Type: token.String, Line: 1, Str: `"\u{1F345}"`, Literal: "🍅"}},
+		{`"\u{10FFFF}"`, token.Token{Type: token.String, Line: 1, Str: `"\u{10FFFF}"`, Literal: "\U0010FFFF"}},
+		{`"🍅 ok"`, token.Token{Type: token.String, Line: 1, Str: `"🍅 ok"`, Literal: "🍅 ok"}},
+		{`"a\n${`, token.Token{Type: token.Interpolation, Line: 1, Str: `"a\n${`, Literal: "a\n"}},
+		{`"\q"`, token.Token{Type: token.Error, Line: 1, Str: `invalid escape sequence '\q'`}},
+		{`"\é"`, token.Token{Type: token.Error, Line: 1, Str: `invalid escape sequence '\é'`}},
+		{"\"a\\\nb\"", token.Token{Type: token.Error, Line: 1, Str: `invalid escape sequence '\' at end of line`}},
+		{`"\u41"`, token.Token{Type: token.Error, Line: 1, Str: `expect '{' after '\u'`}},
+		{`"\u{41"`, token.Token{Type: token.Error, Line: 1, Str: `unterminated unicode escape '\u{41'`}},
+		{`"\u{}"`, token.Token{Type: token.Error, Line: 1, Str: `invalid unicode escape '\u{}'`}},
+		{`"\u{xyz}"`, token.Token{Type: token.Error, Line: 1, Str: `invalid unicode escape '\u{xyz}'`}},
+		{`"\u{0000041}"`, token.Token{Type: token.Error, Line: 1, Str: `invalid unicode escape '\u{0000041}'`}},
+		{`"\u{110000}"`, token.Token{Type: token.Error, Line: 1, Str: `invalid code point '\u{110000}'`}},
+		{`"\u{D800}"`, token.Token{Type: token.Error, Line: 1, Str: `invalid code point '\u{D800}'`}},
+		{"\"first\n\\q\"", token.Token{Type: token.Error, Line: 2, Str: `invalid escape sequence '\q'`}},
+	}
+
+	for index, tc := range testCases {
+		t.Run(fmt.Sprintf("%d - %s", index, tc.text), func(t *testing.T) {
+			scan := scanner.NewScanner(tc.text)
+			assert.Equal(t, tc.expected, scan.ScanToken())
+		})
+	}
+}
+
+func TestScanTokenResumesAfterInvalidEscape(t *testing.T) {
+	scan := scanner.NewScanner(`"\q\n" + x`)
+
+	assert.Equal(t, token.Error, scan.ScanToken().Type)
+	assert.Equal(t, token.Plus, scan.ScanToken().Type)
+	assert.Equal(t, token.Identifier, scan.ScanToken().Type)
+	assert.Equal(t, token.EOF, scan.ScanToken().Type)
+}
+
+func TestScanTokenUnicode(t *testing.T) {
+	testCases := []struct {
+		text     string
+		expected []token.Token
+		cursor   int
+	}{
+		{
+			text: "café = naïve_1;",
+			expected: []token.Token{
+				{Type: token.Identifier, Line: 1, Str: "café"},
+				{Type: token.Equal, Line: 1, Str: "="},
+				{Type: token.Identifier, Line: 1, Str: "naïve_1"},
+				{Type: token.Semicolon, Line: 1, Str: ";"},
+			},
+			cursor: 15,
+		},
+		{
+			text: "変数 + Δ",
+			expected: []token.Token{
+				{Type: token.Identifier, Line: 1, Str: "変数"},
+				{Type: token.Plus, Line: 1, Str: "+"},
+				{Type: token.Identifier, Line: 1, Str: "Δ"},
+			},
+			cursor: 6,
+		},
+		{
+			text: `"🍅🍅" 🍅`,
+			expected: []token.Token{
+				{Type: token.String, Line: 1, Str: `"🍅🍅"`, Literal: "🍅🍅"},
+				{Type: token.Error, Line: 1, Str: "unexpected character '🍅'"},
+			},
+			cursor: 6,
+		},
+		{
+			text: "// комментарий\n// more\nx",
+			expected: []token.Token{
+				{Type: token.Identifier, Line: 3, Str: "x"},
+			},
+			cursor: 24,
+		},
+	}
+
+	for index, tc := range testCases {
+		t.Run(fmt.Sprintf("%d - %s", index, tc.text), func(t *testing.T) {
+			scan := scanner.NewScanner(tc.text)
+
+			for _, expected := range tc.expected {
+				assert.Equal(t, expected, scan.ScanToken())
+			}
+
+			assert.Equal(t, tc.cursor, scan.Cursor)
+		})
+	}
+}
+
+func TestScannerClone(t *testing.T) {
+	scan := scanner.NewScanner(`x in "a${b}c"`)
+	assert.Equal(t, token.Identifier, scan.ScanToken().Type)
+
+	lookahead := scan.Clone()
+	for _, expected := range []token.TokenType{token.In, token.Interpolation, token.Identifier, token.String} {
+		assert.Equal(t, expected, lookahead.ScanToken().Type)
+	}
+
+	assert.Equal(t, token.EOF, lookahead.ScanToken().Type)
+
+	assert.Equal(t, token.In, scan.ScanToken().Type)
+	assert.Equal(t, token.Interpolation, scan.ScanToken().Type)
+
+	// the clone doesn't share the interpolations the scanner is inside of.
+	inside := scan.Clone()
+	assert.Equal(t, token.Identifier, inside.ScanToken().Type)
+	assert.Equal(t, token.String, inside.ScanToken().Type)
+
+	assert.Equal(t, token.Identifier, scan.ScanToken().Type)
+	assert.Equal(t, token.String, scan.ScanToken().Type)
+	assert.Equal(t, token.EOF, scan.ScanToken().Type)
+}
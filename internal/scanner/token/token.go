@@ -7,6 +7,10 @@ type (
 		Type TokenType
 		Str  string
 		Line int
+
+		// Literal holds the contents of a String or Interpolation token with its delimiters
+		// removed and its escape sequences decoded.
+		Literal string
 	}
 )
 
@@ -16,6 +20,9 @@ const (
 	RightParen
 	LeftBrace
 	RightBrace
+	LeftBracket
+	RightBracket
+	Colon
 	Comma
 	Dot
 	Minus
@@ -24,6 +31,10 @@ const (
 	Slash
 	Star
 	Percent
+	Ampersand
+	Pipe
+	Caret
+	Tilde
 
 	// 1-2 character tokens.
 	Bang
@@ -34,29 +45,49 @@ const (
 	GreaterEqual
 	Less
 	LessEqual
+	LessLess
+	GreaterGreater
+	DotDot
+	EqualGreater
 
 	// Literals.
 	Identifier
 	String
 	Number
 
+	// Interpolation is a segment of a string literal followed by an embedded expression. The
+	// expression's tokens come next, then either another Interpolation or the String ending the
+	// literal.
+	Interpolation
+
 	// Keywords.
 	And
+	As
+	Catch
 	Class
 	Else
 	False
+	Finally
 	For
 	Fun
 	If
+	Import
+	In
+	Match
 	Nil
 	Or
 	Print
 	Return
+	Select
+	Spawn
 	Super
 	This
+	Throw
 	True
+	Try
 	Var
 	While
+	Yield
 
 	// Sentinel tokens.
 	Error
@@ -2,8 +2,148 @@ package value
 
 import "fmt"
 
-type Value float64
+type (
+	ValueType uint8
+
+	Value struct {
+		Type    ValueType
+		boolean bool
+		number  float64
+		integer int64
+		obj     Obj
+	}
+
+	// Obj is implemented by every heap-allocated object a Value can refer to. Objects are
+	// compared by identity.
+	Obj interface {
+		String() string
+	}
+)
+
+const (
+	Bool ValueType = iota + 1
+	Nil
+	Number
+	Object
+	Int
+)
+
+func NewBool(b bool) Value {
+	return Value{Type: Bool, boolean: b}
+}
+
+func NewNil() Value {
+	return Value{Type: Nil}
+}
+
+func NewNumber(n float64) Value {
+	return Value{Type: Number, number: n}
+}
+
+func NewInt(i int64) Value {
+	return Value{Type: Int, integer: i}
+}
+
+func NewObj(obj Obj) Value {
+	return Value{Type: Object, obj: obj}
+}
+
+func (v Value) AsBool() bool {
+	return v.boolean
+}
+
+func (v Value) AsNumber() float64 {
+	return v.number
+}
+
+func (v Value) AsInt() int64 {
+	return v.integer
+}
+
+// AsFloat returns the value of a numeric v as a float, promoting ints.
+func (v Value) AsFloat() float64 {
+	if v.IsInt() {
+		return float64(v.integer)
+	}
+
+	return v.number
+}
+
+func (v Value) AsObj() Obj {
+	return v.obj
+}
+
+func (v Value) IsBool() bool {
+	return v.Type == Bool
+}
+
+func (v Value) IsNil() bool {
+	return v.Type == Nil
+}
+
+func (v Value) IsNumber() bool {
+	return v.Type == Number
+}
+
+func (v Value) IsInt() bool {
+	return v.Type == Int
+}
+
+// IsNumeric reports whether v is either an int or a floating point number.
+func (v Value) IsNumeric() bool {
+	return v.IsInt() || v.IsNumber()
+}
+
+func (v Value) IsObj() bool {
+	return v.Type == Object
+}
+
+// IsFalsey reports whether v is treated as false in a boolean context. Only nil and false
+// are falsey, every other value is truthy.
+func (v Value) IsFalsey() bool {
+	return v.IsNil() || (v.IsBool() && !v.AsBool())
+}
 
 func (v Value) String() string {
-	return fmt.Sprintf("%.06f", float64(v))
+	switch v.Type {
+	case Bool:
+		return fmt.Sprintf("%t", v.boolean)
+	case Nil:
+		return "nil"
+	case Number:
+		return fmt.Sprintf("%.06f", v.number)
+	case Int:
+		return fmt.Sprintf("%d", v.integer)
+	case Object:
+		return v.obj.String()
+	default:
+		return fmt.Sprintf("<unknown value type %d>", v.Type)
+	}
+}
+
+// Equal reports whether lhs and rhs hold the same type and the same value. An int and a float
+// are compared by promoting the int to a float.
+func Equal(lhs Value, rhs Value) bool {
+	if lhs.Type != rhs.Type {
+		if lhs.IsNumeric() && rhs.IsNumeric() {
+			return lhs.AsFloat() == rhs.AsFloat()
+		}
+
+		return false
+	}
+
+	switch lhs.Type {
+	case Bool:
+		return lhs.AsBool() == rhs.AsBool()
+	case Nil:
+		return true
+	case Number:
+		return lhs.AsNumber() == rhs.AsNumber()
+	case Int:
+		return lhs.AsInt() == rhs.AsInt()
+	case Object:
+		return lhs.AsObj() == rhs.AsObj()
+	default:
+		return false
+	}
 }
@@ -0,0 +1,245 @@
+package vm
+
+import (
+	"errors"
+
+	"github.com/meanguy/automato/internal/object"
+	"github.com/meanguy/automato/internal/value"
+)
+
+type (
+	// channel passes values between fibers. Sending blocks until a receiver takes the value,
+	// unless the buffer has room for it, and receiving blocks until there's a value to take.
+	// Once a channel is closed, receiving from it drains the buffer and then gives nil.
+	channel struct {
+		object.Header
+
+		capacity  int
+		buffer    []value.Value
+		closed    bool
+		senders   []waiter
+		receivers []waiter
+	}
+
+	// waiter is a fiber blocked on a channel. slots is the number of stack slots the blocking
+	// instruction operated on, which the fiber gets the result in place of. Senders hold the
+	// value they're sending, and receivers blocked in a select the position of the channel
+	// among the ones they're selecting from, or -1.
+	waiter struct {
+		fiber *fiber
+		wait  int
+		slots int
+		value value.Value
+		index int
+	}
+)
+
+// channelNativeName is the name of the built-in function creating channels.
+const channelNativeName = "channel"
+
+var (
+	errChannelArity    = errors.New("expected 0 or 1 arguments")
+	errChannelCapacity = errors.New("channel capacity must be a non-negative integer")
+)
+
+//nolint:gochecknoglobals // read-only lookup table
+var channelMethods = map[string]builtinMethod[*channel]{
+	"close": {arity: 0, fn: channelClose},
+	"recv":  {arity: 0, fn: channelRecv},
+	"send":  {arity: 1, fn: channelSend},
+}
+
+func (c *channel) String() string {
+	return "<channel>"
+}
+
+// live reports whether the fiber is still blocked on the wait w was queued for.
+func (w waiter) live() bool {
+	return w.fiber.state == fiberBlocked && w.fiber.wait == w.wait
+}
+
+// makeChannel is the built-in function creating channels, unbuffered unless it's given a
+// capacity.
+func (v *VM) makeChannel(args []value.Value) (value.Value, error) {
+	if len(args) > 1 {
+		return value.NewNil(), errChannelArity
+	}
+
+	capacity := 0
+	if len(args) == 1 {
+		if !args[0].IsInt() || args[0].AsInt() < 0 {
+			return value.NewNil(), errChannelCapacity
+		}
+
+		capacity = int(args[0].AsInt())
+	}
+
+	return value.NewObj(v.newChannel(capacity)), nil
+}
+
+// popWaiter removes the first fiber still blocked in queue.
+func popWaiter(queue *[]waiter) (waiter, bool) {
+	for len(*queue) > 0 {
+		w := (*queue)[0]
+		*queue = (*queue)[1:]
+
+		if w.live() {
+			return w, true
+		}
+	}
+
+	return waiter{}, false
+}
+
+// wakeReceiver hands val to the receiver w.
+func (v *VM) wakeReceiver(w waiter, val value.Value) {
+	result := val
+	if w.index >= 0 {
+		result = value.NewObj(v.newList([]value.Value{value.NewInt(int64(w.index)), val}))
+	}
+
+	v.wake(w.fiber, w.slots, result, "")
+}
+
+// trySend sends val on c without blocking, reporting whether it could.
+func (v *VM) trySend(c *channel, val value.Value) bool {
+	if w, ok := popWaiter(&c.receivers); ok {
+		v.wakeReceiver(w, val)
+
+		return true
+	}
+
+	if len(c.buffer) < c.capacity {
+		c.buffer = append(c.buffer, val)
+
+		return true
+	}
+
+	return false
+}
+
+// tryRecv receives a value from c without blocking, reporting whether it could.
+func (v *VM) tryRecv(c *channel) (value.Value, bool) {
+	if len(c.buffer) > 0 {
+		val := c.buffer[0]
+		c.buffer = c.buffer[1:]
+
+		// the slot that freed up goes to the first blocked sender.
+		if w, ok := popWaiter(&c.senders); ok {
+			c.buffer = append(c.buffer, w.value)
+			v.wake(w.fiber, w.slots, value.NewNil(), "")
+		}
+
+		return val, true
+	}
+
+	if w, ok := popWaiter(&c.senders); ok {
+		v.wake(w.fiber, w.slots, value.NewNil(), "")
+
+		return w.value, true
+	}
+
+	if c.closed {
+		return value.NewNil(), true
+	}
+
+	return value.NewNil(), false
+}
+
+func channelSend(v *VM, c *channel, args []value.Value) (value.Value, error) {
+	if c.closed {
+		return value.NewNil(), v.runtimeError("send on closed channel")
+	}
+
+	if v.trySend(c, args[0]) {
+		return value.NewNil(), nil
+	}
+
+	c.senders = append(c.senders, waiter{fiber: v.fiber, wait: v.block(), slots: 2, value: args[0], index: -1})
+
+	return value.NewNil(), errSuspended
+}
+
+func channelRecv(v *VM, c *channel, _ []value.Value) (value.Value, error) {
+	if val, ok := v.tryRecv(c); ok {
+		return val, nil
+	}
+
+	c.receivers = append(c.receivers, waiter{fiber: v.fiber, wait: v.block(), slots: 1, value: value.NewNil(), index: -1})
+
+	return value.NewNil(), errSuspended
+}
+
+// channelClose closes c, waking every blocked receiver with nil. Blocked senders wake up to a
+// runtime error.
+func channelClose(v *VM, c *channel, _ []value.Value) (value.Value, error) {
+	if c.closed {
+		return value.NewNil(), v.runtimeError("channel is already closed")
+	}
+
+	c.closed = true
+
+	for w, ok := popWaiter(&c.receivers); ok; w, ok = popWaiter(&c.receivers) {
+		v.wakeReceiver(w, value.NewNil())
+	}
+
+	for w, ok := popWaiter(&c.senders); ok; w, ok = popWaiter(&c.senders) {
+		v.wake(w.fiber, w.slots, value.NewNil(), "send on closed channel")
+	}
+
+	return value.NewNil(), nil
+}
+
+// selectChannels receives from the first of the count channels on top of the stack that has a
+// value, replacing them with a list of its position and the value. If none has one the fiber
+// blocks on all of them.
+func (v *VM) selectChannels(count int) error {
+	if count == 0 {
+		return v.runtimeError("select needs at least one channel")
+	}
+
+	channels := make([]*channel, count)
+
+	for i := range channels {
+		c, ok := asChannel(v.Peek(count - 1 - i))
+		if !ok {
+			return v.runtimeError("can only select from channels")
+		}
+
+		channels[i] = c
+	}
+
+	for i, c := range channels {
+		if val, ok := v.tryRecv(c); ok {
+			v.Push(val) // the list allocates
+			result := v.newList([]value.Value{value.NewInt(int64(i)), val})
+			v.Stack = v.Stack[:len(v.Stack)-count-1]
+			v.Push(value.NewObj(result))
+
+			return nil
+		}
+	}
+
+	wait := v.block()
+	for i, c := range channels {
+		c.receivers = append(c.receivers, waiter{fiber: v.fiber, wait: wait, slots: count, value: value.NewNil(), index: i})
+	}
+
+	return errSuspended
+}
+
+func asChannel(val value.Value) (*channel, bool) {
+	if !val.IsObj() {
+		return nil, false
+	}
+
+	c, ok := val.AsObj().(*channel)
+
+	return c, ok
+}
+
+func isChannel(val value.Value) bool {
+	_, ok := asChannel(val)
+
+	return ok
+}
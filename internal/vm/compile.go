@@ -1,14 +1,17 @@
 package vm
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/meanguy/automato/internal/debug"
 	"github.com/meanguy/automato/internal/mem"
+	"github.com/meanguy/automato/internal/object"
 	"github.com/meanguy/automato/internal/opcode"
 	"github.com/meanguy/automato/internal/scanner"
 	"github.com/meanguy/automato/internal/scanner/token"
@@ -19,65 +22,177 @@ type (
 	parser struct {
 		current  token.Token
 		previous token.Token
-		chunk    mem.Chunk
+		compiler *compiler
+		class    *classCompiler
+		module   *object.Module
+		vm       *VM
 		scan     *scanner.Scanner
 		debug    bool
 		fatal    bool
 		err      error
 	}
 
+	// compiler tracks the lexical scopes and stack-allocated locals of the function being
+	// compiled. Compilers for nested functions link back to their enclosing compiler.
+	compiler struct {
+		enclosing  *compiler
+		function   *object.Function
+		kind       functionKind
+		locals     []local
+		upvalues   []upvalue
+		scopeDepth int
+
+		// lastCall is the offset of the call or method invocation emitted last, or -1, so a
+		// spawn statement can turn the call it ends with into a spawn.
+		lastCall int
+
+		// temporaries counts the values the expression being compiled keeps on the stack above
+		// the locals, such as the left operand of a binary operator while the right one is
+		// compiled, so a match can tell which slots its locals go in.
+		temporaries int
+
+		// guardParen is set when a match guard starts with '('. The '=>' after it ends the
+		// guard, so that '(' opens a grouping rather than an arrow function.
+		guardParen bool
+	}
+
+	// classCompiler tracks the class declaration being compiled, if any, so methods know
+	// whether 'this' is available.
+	classCompiler struct {
+		enclosing     *classCompiler
+		hasSuperclass bool
+	}
+
+	local struct {
+		name       token.Token
+		depth      int
+		isCaptured bool
+	}
+
+	// upvalue is a variable captured from an enclosing function. index refers to a local slot
+	// of the enclosing function when isLocal is set, otherwise to one of its upvalues.
+	upvalue struct {
+		index   int
+		isLocal bool
+	}
+
+	// matchArm tracks the arm of a match being compiled. base is the number of locals it
+	// started with, and fails lists the jumps it takes when its pattern or guard doesn't fit.
+	matchArm struct {
+		base  int
+		fails []matchFail
+	}
+
+	// matchFail is a jump out of a match arm, along with the number of values it leaves on the
+	// stack above the arm's locals.
+	matchFail struct {
+		offset int
+		depth  int
+	}
+
+	functionKind int
+
 	precedence int
 )
 
+const (
+	scriptKind functionKind = iota + 1
+	functionBodyKind
+	methodKind
+	initializerKind
+)
+
+// initializerName is the name of the method called to initialize new instances of a class.
+const initializerName = "init"
+
+// wildcardName is the pattern that fits any value without binding it.
+const wildcardName = "_"
+
+const (
+	maxLocals    = math.MaxUint8 + 1
+	maxUpvalues  = math.MaxUint8 + 1
+	maxArguments = math.MaxUint8
+	maxElements  = math.MaxUint16
+
+	// uninitializedDepth marks a local that has been declared but whose initializer has not
+	// finished compiling yet.
+	uninitializedDepth = -1
+
+	// callSize and invokeSize are the sizes of OpCall and OpInvoke instructions, and of the
+	// spawn instructions that replace them.
+	callSize   = 2
+	invokeSize = 4
+)
+
 const (
 	noPrecedence precedence = iota + 1
 	assignmentPrecedence
-	// orPrecedence
-	// andPrecedence
-	// equalityPrecedence
-	// comparisonPrecedence.
+	orPrecedence
+	andPrecedence
+	equalityPrecedence
+	comparisonPrecedence
+	rangePrecedence
+	bitwiseOrPrecedence
+	bitwiseXorPrecedence
+	bitwiseAndPrecedence
+	shiftPrecedence
 	termPrecedence
 	farctorPrecedence
 	unaryPrecedence
-	// callPrecedence
+	callPrecedence
 	// primaryPrecedence.
 )
 
-func newParser(scan *scanner.Scanner, debug bool) *parser {
-	return &parser{
+// newParser returns a parser compiling the script scanned by scan into module.
+func newParser(vm *VM, scan *scanner.Scanner, module *object.Module) *parser {
+	p := &parser{
 		current:  token.Token{},
 		previous: token.Token{},
-		chunk:    mem.Chunk{},
+		compiler: nil,
+		class:    nil,
+		module:   module,
+		vm:       vm,
 		scan:     scan,
-		debug:    debug,
+		debug:    vm.Debug,
 		fatal:    false,
 		err:      nil,
 	}
+
+	p.beginCompiler(scriptKind)
+
+	return p
 }
 
-func (p *parser) compile() (*mem.Chunk, error) {
+func (p *parser) compile() (*object.Function, error) {
 	p.advance()
-	p.expression()
-	p.consume(token.EOF, "expect end of expression")
-	p.endCompiler()
+
+	for !p.match(token.EOF) {
+		p.declaration()
+	}
+
+	function := p.endCompiler()
 
 	if err := p.Err(); err != nil {
 		return nil, err
 	}
 
-	return &p.chunk, nil
+	return function, nil
+}
+
+func (p *parser) currentChunk() *mem.Chunk {
+	return &p.compiler.function.Chunk
 }
 
 func (p *parser) emitByte(b byte, line int) {
-	p.chunk.Write(b, line)
+	p.currentChunk().Write(b, line)
 }
 
 func (p *parser) emitWord(word uint16, line int) {
-	p.chunk.WriteWord(word, line)
+	p.currentChunk().WriteWord(word, line)
 }
 
 func (p *parser) emitConstant(val value.Value, line int) {
-	constantID := p.chunk.AddConstant(val)
+	constantID := p.makeConstant(val)
 	if constantID > math.MaxUint8 {
 		p.emitOpCode(opcode.OpConstantLong, line)
 		p.emitWord(uint16(constantID), line)
@@ -87,16 +202,152 @@ func (p *parser) emitConstant(val value.Value, line int) {
 	}
 }
 
+// emitNameOp emits an instruction, such as a global or property access, operating on the name
+// constant nameID.
+func (p *parser) emitNameOp(op opcode.OpCode, nameID int, line int) {
+	p.emitOpCode(op, line)
+	p.emitWord(uint16(nameID), line)
+}
+
+func (p *parser) emitGetLocal(slot int, line int) {
+	p.emitOpCode(opcode.OpGetLocal, line)
+	p.emitByte(byte(slot), line)
+}
+
 func (p *parser) emitOpCode(op opcode.OpCode, line int) {
-	p.chunk.WriteOp(op, line)
+	p.currentChunk().WriteOp(op, line)
+}
+
+// emitJump emits a forward jump with a placeholder offset and returns the offset of the
+// placeholder so it can be backpatched with patchJump.
+func (p *parser) emitJump(op opcode.OpCode, line int) int {
+	p.emitOpCode(op, line)
+	p.emitWord(math.MaxUint16, line)
+
+	return len(p.currentChunk().Code) - 2
+}
+
+func (p *parser) patchJump(offset int) {
+	jump := len(p.currentChunk().Code) - offset - 2 // -2 to account for the jump offset itself
+	if jump > math.MaxUint16 {
+		p.errorAtPrevious("too much code to jump over")
+
+		return
+	}
+
+	p.currentChunk().Code[offset] = uint8((jump >> 8) & 0xff)
+	p.currentChunk().Code[offset+1] = uint8(jump & 0xff)
+}
+
+func (p *parser) emitLoop(loopStart int, line int) {
+	p.emitOpCode(opcode.OpLoop, line)
+
+	jump := len(p.currentChunk().Code) - loopStart + 2 // +2 to account for the loop offset itself
+	if jump > math.MaxUint16 {
+		p.errorAtPrevious("loop body too large")
+	}
+
+	p.emitWord(uint16(jump), line)
+}
+
+func (p *parser) makeConstant(val value.Value) int {
+	constantID := p.currentChunk().AddConstant(val)
+	if constantID > math.MaxUint16 {
+		p.errorAtPrevious("too many constants in one chunk")
+
+		return 0
+	}
+
+	return constantID
+}
+
+func (p *parser) identifierConstant(name token.Token) int {
+	return p.makeConstant(value.NewObj(p.vm.internString(name.Str)))
+}
+
+// beginCompiler starts compiling a new function of the given kind nested in the current one.
+func (p *parser) beginCompiler(kind functionKind) {
+	p.compiler = &compiler{
+		enclosing:   p.compiler,
+		function:    p.vm.newFunction(),
+		kind:        kind,
+		locals:      make([]local, 0, maxLocals),
+		upvalues:    nil,
+		scopeDepth:  0,
+		lastCall:    -1,
+		temporaries: 0,
+		guardParen:  false,
+	}
+
+	p.compiler.function.Module = p.module
+
+	// the name is interned once the function is reachable from the compiler so the collector
+	// won't free the function in the meantime.
+	if kind != scriptKind {
+		p.compiler.function.Name = p.vm.internString(p.previous.Str)
+	}
+
+	// slot zero holds the function being called, it has no name so it can't be referenced. In
+	// methods it holds the receiver instead, which is referenced as 'this'.
+	receiver := token.Token{}
+	if kind == methodKind || kind == initializerKind {
+		receiver = token.Token{Type: token.This, Str: "this", Line: p.previous.Line}
+	}
+
+	p.compiler.locals = append(p.compiler.locals, local{name: receiver, depth: 0, isCaptured: false})
 }
 
-func (p *parser) endCompiler() {
+// endCompiler finishes the function being compiled and returns to its enclosing compiler.
+func (p *parser) endCompiler() *object.Function {
+	p.emitReturn()
+
+	function := p.compiler.function
+	for slot := range p.compiler.locals {
+		function.Chunk.EndLocal(slot, len(function.Chunk.Code))
+	}
+
 	if p.debug && p.err == nil {
-		debug.DisassembleChunk(os.Stderr, &p.chunk, "code")
+		debug.DisassembleChunk(os.Stderr, &function.Chunk, function.String())
+	}
+
+	p.compiler = p.compiler.enclosing
+
+	return function
+}
+
+// emitReturn emits an implicit return, which returns the new instance from initializers, the
+// module from scripts so imports can bind it, and nil from every other function.
+func (p *parser) emitReturn() {
+	switch p.compiler.kind {
+	case initializerKind:
+		p.emitOpCode(opcode.OpGetLocal, p.previous.Line)
+		p.emitByte(0, p.previous.Line)
+	case scriptKind:
+		p.emitConstant(value.NewObj(p.module), p.previous.Line)
+	case functionBodyKind, methodKind:
+		p.emitOpCode(opcode.OpNil, p.previous.Line)
 	}
 
-	p.emitOpCode(opcode.OpReturn, p.current.Line)
+	p.emitOpCode(opcode.OpReturn, p.previous.Line)
+}
+
+func (p *parser) beginScope() {
+	p.compiler.scopeDepth++
+}
+
+func (p *parser) endScope() {
+	p.compiler.scopeDepth--
+
+	for n := len(p.compiler.locals); n > 0 && p.compiler.locals[n-1].depth > p.compiler.scopeDepth; n-- {
+		if p.compiler.locals[n-1].isCaptured {
+			p.emitOpCode(opcode.OpCloseUpvalue, p.previous.Line)
+		} else {
+			p.emitOpCode(opcode.OpPop, p.previous.Line)
+		}
+
+		p.currentChunk().EndLocal(n-1, len(p.currentChunk().Code))
+		p.compiler.locals = p.compiler.locals[:n-1]
+	}
 }
 
 func (p *parser) parsePrecedence(prec precedence) {
@@ -109,11 +360,18 @@ func (p *parser) parsePrecedence(prec precedence) {
 		return
 	}
 
+	canAssign := prec <= assignmentPrecedence
+	prefix(p, canAssign)
+
 	for prec <= getParseRule(p.current.Type).precedence {
 		p.advance()
 
 		infix := getParseRule(p.previous.Type).infix
-		infix(p)
+		infix(p, canAssign)
+	}
+
+	if canAssign && p.match(token.Equal) {
+		p.errorAtPrevious("invalid assignment target")
 	}
 }
 
@@ -141,13 +399,45 @@ func (p *parser) consume(tokenType token.TokenType, msg string) {
 	p.errorAtCurrent(msg)
 }
 
+func (p *parser) check(tokenType token.TokenType) bool {
+	return p.current.Type == tokenType
+}
+
+func (p *parser) match(tokenType token.TokenType) bool {
+	if !p.check(tokenType) {
+		return false
+	}
+
+	p.advance()
+
+	return true
+}
+
 func (p *parser) binary() {
 	operatorType := p.previous.Type
 	rule := getParseRule(operatorType)
-	p.parsePrecedence(rule.precedence)
+
+	p.compiler.temporaries++ // the left operand
+	p.parsePrecedence(rule.precedence + 1)
+	p.compiler.temporaries--
 
 	//nolint:exhaustive // we only care about a couple of token types
 	switch operatorType {
+	case token.BangEqual:
+		p.emitOpCode(opcode.OpEqual, p.previous.Line)
+		p.emitOpCode(opcode.OpNot, p.previous.Line)
+	case token.EqualEqual:
+		p.emitOpCode(opcode.OpEqual, p.previous.Line)
+	case token.Greater:
+		p.emitOpCode(opcode.OpGreater, p.previous.Line)
+	case token.GreaterEqual:
+		p.emitOpCode(opcode.OpLess, p.previous.Line)
+		p.emitOpCode(opcode.OpNot, p.previous.Line)
+	case token.Less:
+		p.emitOpCode(opcode.OpLess, p.previous.Line)
+	case token.LessEqual:
+		p.emitOpCode(opcode.OpGreater, p.previous.Line)
+		p.emitOpCode(opcode.OpNot, p.previous.Line)
 	case token.Plus:
 		p.emitOpCode(opcode.OpAdd, p.previous.Line)
 	case token.Minus:
@@ -156,28 +446,1399 @@ func (p *parser) binary() {
 		p.emitOpCode(opcode.OpMultiply, p.previous.Line)
 	case token.Slash:
 		p.emitOpCode(opcode.OpDivide, p.previous.Line)
+	case token.Percent:
+		p.emitOpCode(opcode.OpModulo, p.previous.Line)
+	case token.Ampersand:
+		p.emitOpCode(opcode.OpBitAnd, p.previous.Line)
+	case token.Pipe:
+		p.emitOpCode(opcode.OpBitOr, p.previous.Line)
+	case token.Caret:
+		p.emitOpCode(opcode.OpBitXor, p.previous.Line)
+	case token.LessLess:
+		p.emitOpCode(opcode.OpShiftLeft, p.previous.Line)
+	case token.GreaterGreater:
+		p.emitOpCode(opcode.OpShiftRight, p.previous.Line)
+	case token.DotDot:
+		p.emitOpCode(opcode.OpRange, p.previous.Line)
 	default:
 		return
 	}
 }
 
-func (p *parser) expression() {
-	p.parsePrecedence(assignmentPrecedence)
+func (p *parser) declaration() {
+	switch {
+	case p.match(token.Class):
+		p.classDeclaration()
+	case p.match(token.Fun):
+		p.funDeclaration()
+	case p.match(token.Import):
+		p.importDeclaration()
+	case p.match(token.Var):
+		p.varDeclaration()
+	default:
+		p.statement()
+	}
 }
 
-func (p *parser) grouping() {
+func (p *parser) classDeclaration() {
+	p.consume(token.Identifier, "expect class name")
+
+	className := p.previous
+	nameID := p.identifierConstant(className)
+	p.declareVariable()
+
+	p.emitNameOp(opcode.OpClass, nameID, className.Line)
+	p.defineVariable(nameID)
+
+	p.class = &classCompiler{enclosing: p.class, hasSuperclass: false}
+
+	if p.match(token.Less) {
+		p.consume(token.Identifier, "expect superclass name")
+		p.variable(false)
+
+		if className.Str == p.previous.Str {
+			p.errorAtPrevious("a class can't inherit from itself")
+		}
+
+		// super is bound in a scope wrapping the methods so their closures can capture it.
+		p.beginScope()
+		p.addLocal(token.Token{Type: token.Super, Str: "super", Line: p.previous.Line})
+		p.defineVariable(0)
+
+		p.namedVariable(className, false)
+		p.emitOpCode(opcode.OpInherit, p.previous.Line)
+		p.class.hasSuperclass = true
+	}
+
+	p.namedVariable(className, false)
+	p.consume(token.LeftBrace, "expect '{' before class body")
+
+	for !p.check(token.RightBrace) && !p.check(token.EOF) {
+		p.method()
+	}
+
+	p.consume(token.RightBrace, "expect '}' after class body")
+	p.emitOpCode(opcode.OpPop, p.previous.Line)
+
+	if p.class.hasSuperclass {
+		p.endScope()
+	}
+
+	p.class = p.class.enclosing
+}
+
+func (p *parser) method() {
+	p.consume(token.Identifier, "expect method name")
+	nameID := p.identifierConstant(p.previous)
+
+	kind := methodKind
+	if p.previous.Str == initializerName {
+		kind = initializerKind
+	}
+
+	p.function(kind)
+	p.emitNameOp(opcode.OpMethod, nameID, p.previous.Line)
+}
+
+func (p *parser) funDeclaration() {
+	global := p.parseVariable("expect function name")
+
+	if p.compiler.scopeDepth > 0 {
+		p.markInitialized() // functions may refer to themselves recursively
+	}
+
+	p.function(functionBodyKind)
+	p.defineVariable(global)
+}
+
+func (p *parser) function(kind functionKind) {
+	p.beginCompiler(kind)
+	p.beginScope()
+
+	p.consume(token.LeftParen, "expect '(' after function name")
+	p.parameterList()
+	p.consume(token.LeftBrace, "expect '{' before function body")
+	p.block()
+
+	p.endClosure(p.previous.Line)
+}
+
+// beginLambda starts compiling an anonymous function, which is named after the line it's
+// defined on.
+func (p *parser) beginLambda(line int) {
+	p.beginCompiler(functionBodyKind)
+	p.compiler.function.Name = p.vm.internString(fmt.Sprintf("<lambda@%d>", line))
+	p.beginScope()
+}
+
+// lambda compiles an anonymous function expression.
+func (p *parser) lambda() {
+	p.beginLambda(p.previous.Line)
+
+	p.consume(token.LeftParen, "expect '(' after 'fun'")
+	p.parameterList()
+	p.consume(token.LeftBrace, "expect '{' before function body")
+	p.block()
+
+	p.endClosure(p.previous.Line)
+}
+
+// arrowFunction compiles an arrow function, whose body is a single expression it returns. The
+// '(' opening its parameter list has been consumed.
+func (p *parser) arrowFunction() {
+	p.beginLambda(p.previous.Line)
+
+	p.parameterList()
+	p.consume(token.EqualGreater, "expect '=>' after arrow function parameters")
 	p.expression()
+	p.emitOpCode(opcode.OpReturn, p.previous.Line)
 
-	p.consume(token.RightParen, "expected ')' after expression")
+	p.endClosure(p.previous.Line)
 }
 
-func (p *parser) number() {
-	val, err := strconv.ParseFloat(p.previous.Str, 64)
-	if err != nil {
-		p.errorAtCurrent("failed to parse number '%s': %v", p.previous.Str, err)
+// parameterList declares the parameters of the function being compiled, up to and including
+// the closing ')'.
+func (p *parser) parameterList() {
+	if !p.check(token.RightParen) {
+		for {
+			p.compiler.function.Arity++
+			if p.compiler.function.Arity > maxArguments {
+				p.errorAtCurrent("can't have more than %d parameters", maxArguments)
+			}
+
+			param := p.parseVariable("expect parameter name")
+			p.defineVariable(param)
+
+			if !p.match(token.Comma) {
+				break
+			}
+		}
+	}
+
+	p.consume(token.RightParen, "expect ')' after parameters")
+}
+
+// endClosure finishes the function being compiled and emits a closure over it in the enclosing
+// function.
+func (p *parser) endClosure(line int) {
+	upvalues := p.compiler.upvalues
+	function := p.endCompiler()
+
+	p.emitOpCode(opcode.OpClosure, line)
+	p.emitWord(uint16(p.makeConstant(value.NewObj(function))), line)
+
+	for _, upvalue := range upvalues {
+		isLocal := byte(0)
+		if upvalue.isLocal {
+			isLocal = 1
+		}
+
+		p.emitByte(isLocal, line)
+		p.emitByte(byte(upvalue.index), line)
+	}
+}
+
+// importDeclaration compiles an import, which loads a module and binds it to a variable.
+func (p *parser) importDeclaration() {
+	line := p.previous.Line
+
+	p.consume(token.String, "expect module path after 'import'")
+	pathID := p.makeConstant(value.NewObj(p.vm.internString(p.previous.Literal)))
+
+	p.consume(token.As, "expect 'as' after module path")
+	global := p.parseVariable("expect module name")
+	p.consume(token.Semicolon, "expect ';' after import")
+
+	p.emitNameOp(opcode.OpImport, pathID, line)
+	p.defineVariable(global)
+}
+
+func (p *parser) varDeclaration() {
+	global := p.parseVariable("expect variable name")
+
+	if p.match(token.Equal) {
+		p.expression()
+	} else {
+		p.emitOpCode(opcode.OpNil, p.previous.Line)
+	}
+
+	p.consume(token.Semicolon, "expect ';' after variable declaration")
+	p.defineVariable(global)
+}
+
+// parseVariable consumes a variable name and declares it. Globals are looked up by name at
+// runtime so their name constant is returned, locals return 0 as they're resolved to slots.
+func (p *parser) parseVariable(msg string) int {
+	p.consume(token.Identifier, msg)
+
+	p.declareVariable()
+	if p.compiler.scopeDepth > 0 {
+		return 0
+	}
+
+	return p.identifierConstant(p.previous)
+}
+
+func (p *parser) declareVariable() {
+	if p.compiler.scopeDepth == 0 {
+		return
+	}
+
+	name := p.previous
+	for i := len(p.compiler.locals) - 1; i >= 0; i-- {
+		// a variable still being declared belongs to the statement around the expression
+		// declaring this one, so it's in an enclosing scope.
+		local := p.compiler.locals[i]
+		if local.depth < p.compiler.scopeDepth {
+			break
+		}
+
+		if local.name.Str == name.Str {
+			p.errorAtPrevious("already a variable with this name in this scope")
+		}
+	}
+
+	p.addLocal(name)
+}
+
+func (p *parser) addLocal(name token.Token) {
+	if len(p.compiler.locals) == maxLocals {
+		p.errorAtPrevious("too many local variables in function")
+
+		return
+	}
+
+	p.compiler.locals = append(p.compiler.locals, local{name: name, depth: uninitializedDepth, isCaptured: false})
+}
+
+func (p *parser) markInitialized() {
+	slot := len(p.compiler.locals) - 1
+	p.compiler.locals[slot].depth = p.compiler.scopeDepth
+	p.currentChunk().BeginLocal(p.compiler.locals[slot].name.Str, slot, len(p.currentChunk().Code))
+}
+
+func (p *parser) defineVariable(global int) {
+	if p.compiler.scopeDepth > 0 {
+		p.markInitialized()
+
+		return
+	}
+
+	p.emitNameOp(opcode.OpDefineGlobal, global, p.previous.Line)
+}
+
+// resolveLocal returns the stack slot of the innermost local of c named name, or -1 if there
+// is no such local.
+func (p *parser) resolveLocal(c *compiler, name token.Token) int {
+	for i := len(c.locals) - 1; i >= 0; i-- {
+		local := c.locals[i]
+		if local.name.Str != name.Str {
+			continue
+		}
+
+		if local.depth == uninitializedDepth {
+			p.errorAtPrevious("can't read local variable in its own initializer")
+		}
+
+		return i
+	}
+
+	return -1
+}
+
+// resolveUpvalue returns the index of the upvalue of c capturing name from an enclosing
+// function, or -1 if name isn't a local of any enclosing function and so refers to a global.
+func (p *parser) resolveUpvalue(c *compiler, name token.Token) int {
+	if c.enclosing == nil {
+		return -1
+	}
+
+	if slot := p.resolveLocal(c.enclosing, name); slot >= 0 {
+		c.enclosing.locals[slot].isCaptured = true
+
+		return p.addUpvalue(c, name, slot, true)
+	}
+
+	if index := p.resolveUpvalue(c.enclosing, name); index >= 0 {
+		return p.addUpvalue(c, name, index, false)
+	}
+
+	return -1
+}
+
+func (p *parser) addUpvalue(c *compiler, name token.Token, index int, isLocal bool) int {
+	for i, upvalue := range c.upvalues {
+		if upvalue.index == index && upvalue.isLocal == isLocal {
+			return i
+		}
+	}
+
+	if len(c.upvalues) == maxUpvalues {
+		p.errorAtPrevious("too many closure variables in function")
+
+		return 0
+	}
+
+	c.upvalues = append(c.upvalues, upvalue{index: index, isLocal: isLocal})
+	c.function.UpvalueCount++
+	c.function.UpvalueNames = append(c.function.UpvalueNames, name.Str)
+
+	return len(c.upvalues) - 1
+}
+
+func (p *parser) statement() {
+	switch {
+	case p.match(token.Print):
+		p.printStatement()
+	case p.match(token.If):
+		p.ifStatement()
+	case p.match(token.Return):
+		p.returnStatement()
+	case p.match(token.While):
+		p.whileStatement()
+	case p.match(token.Yield):
+		p.yieldStatement()
+	case p.match(token.Spawn):
+		p.spawnStatement()
+	case p.match(token.Throw):
+		p.throwStatement()
+	case p.match(token.Try):
+		p.tryStatement()
+	case p.match(token.For):
+		p.forStatement()
+	case p.match(token.LeftBrace):
+		p.beginScope()
+		p.block()
+		p.endScope()
+	default:
+		p.expressionStatement()
+	}
+}
+
+func (p *parser) block() {
+	for !p.check(token.RightBrace) && !p.check(token.EOF) {
+		p.declaration()
+	}
+
+	p.consume(token.RightBrace, "expect '}' after block")
+}
+
+func (p *parser) printStatement() {
+	p.expression()
+	p.consume(token.Semicolon, "expect ';' after value")
+	p.emitOpCode(opcode.OpPrint, p.previous.Line)
+}
+
+func (p *parser) ifStatement() {
+	p.consume(token.LeftParen, "expect '(' after 'if'")
+	p.expression()
+	p.consume(token.RightParen, "expect ')' after condition")
+
+	thenJump := p.emitJump(opcode.OpJumpIfFalse, p.previous.Line)
+	p.emitOpCode(opcode.OpPop, p.previous.Line)
+	p.statement()
+
+	elseJump := p.emitJump(opcode.OpJump, p.previous.Line)
+
+	p.patchJump(thenJump)
+	p.emitOpCode(opcode.OpPop, p.previous.Line)
+
+	if p.match(token.Else) {
+		p.statement()
+	}
+
+	p.patchJump(elseJump)
+}
+
+func (p *parser) returnStatement() {
+	if p.compiler.kind == scriptKind {
+		p.errorAtPrevious("can't return from top-level code")
+	}
+
+	if p.match(token.Semicolon) {
+		p.emitReturn()
+
+		return
+	}
+
+	if p.compiler.kind == initializerKind {
+		p.errorAtPrevious("can't return a value from an initializer")
+	}
+
+	p.expression()
+	p.consume(token.Semicolon, "expect ';' after return value")
+	p.emitOpCode(opcode.OpReturn, p.previous.Line)
+}
+
+// yieldStatement compiles a yield, which makes the function being compiled a generator.
+func (p *parser) yieldStatement() {
+	switch p.compiler.kind {
+	case scriptKind:
+		p.errorAtPrevious("can't yield from top-level code")
+	case initializerKind:
+		p.errorAtPrevious("can't yield from an initializer")
+	case functionBodyKind, methodKind:
+		p.compiler.function.IsGenerator = true
+	}
+
+	if p.match(token.Semicolon) {
+		p.emitOpCode(opcode.OpNil, p.previous.Line)
+	} else {
+		p.expression()
+		p.consume(token.Semicolon, "expect ';' after yielded value")
+	}
+
+	p.emitOpCode(opcode.OpYield, p.previous.Line)
+}
+
+// spawnStatement compiles a spawn, which runs the call it's given in a new fiber. The call is
+// compiled as usual, and then its instruction is swapped for the matching spawn instruction.
+// Only calls and the property accesses and indexing leading up to them are parsed, so operators
+// can't skip the call or leave values around it on the stack.
+func (p *parser) spawnStatement() {
+	p.parsePrecedence(callPrecedence)
+
+	code := p.currentChunk().Code
+	switch call := p.compiler.lastCall; {
+	case getParseRule(p.current.Type).infix != nil:
+		p.errorAtCurrent("expect a call after 'spawn'")
+	case call == len(code)-callSize && opcode.OpCode(code[call]) == opcode.OpCall:
+		code[call] = byte(opcode.OpSpawn)
+	case call == len(code)-invokeSize && opcode.OpCode(code[call]) == opcode.OpInvoke:
+		code[call] = byte(opcode.OpSpawnInvoke)
+	default:
+		p.errorAtPrevious("expect a call after 'spawn'")
+	}
+
+	p.consume(token.Semicolon, "expect ';' after spawned call")
+}
+
+func (p *parser) throwStatement() {
+	p.expression()
+	p.consume(token.Semicolon, "expect ';' after thrown value")
+	p.emitOpCode(opcode.OpThrow, p.previous.Line)
+}
+
+// tryStatement compiles a try statement guarded by two handlers: the inner one jumps to the
+// catch clause, and the outer one to the finally clause, which runs however the try and catch
+// clauses complete. A missing catch clause rethrows, and a missing finally clause is empty.
+func (p *parser) tryStatement() {
+	line := p.previous.Line
+
+	finallyHandler := p.emitJump(opcode.OpPushFinally, line)
+	catchHandler := p.emitJump(opcode.OpPushCatch, line)
+
+	p.consume(token.LeftBrace, "expect '{' after 'try'")
+	p.beginScope()
+	p.block()
+	p.endScope()
+
+	p.emitOpCode(opcode.OpPopHandler, p.previous.Line)
+	catchJump := p.emitJump(opcode.OpJump, p.previous.Line)
+
+	// the catch handler enters with the thrown value on top of the stack.
+	p.patchJump(catchHandler)
+
+	hasCatch := p.match(token.Catch)
+	if hasCatch {
+		p.catchClause()
+	} else {
+		p.emitOpCode(opcode.OpThrow, p.previous.Line)
+	}
+
+	p.patchJump(catchJump)
+	p.emitOpCode(opcode.OpPopHandler, p.previous.Line)
+	p.emitConstant(value.NewInt(completionNormal), p.previous.Line)
+	p.emitOpCode(opcode.OpNil, p.previous.Line)
+
+	// the finally handler enters with how the try statement completed and its value on top of
+	// the stack, which are kept in hidden locals until OpEndFinally resumes the completion.
+	p.patchJump(finallyHandler)
+	p.beginScope()
+	p.addHiddenLocal(line)
+	p.addHiddenLocal(line)
+
+	switch {
+	case p.match(token.Finally):
+		p.consume(token.LeftBrace, "expect '{' after 'finally'")
+		p.beginScope()
+		p.block()
+		p.endScope()
+	case !hasCatch:
+		p.errorAtCurrent("expect 'catch' or 'finally' after try block")
+	}
+
+	for i := 0; i < 2; i++ {
+		p.currentChunk().EndLocal(len(p.compiler.locals)-1, len(p.currentChunk().Code))
+		p.compiler.locals = p.compiler.locals[:len(p.compiler.locals)-1]
+	}
+
+	p.compiler.scopeDepth--
+	p.emitOpCode(opcode.OpEndFinally, p.previous.Line)
+}
+
+func (p *parser) catchClause() {
+	p.beginScope()
+
+	if p.match(token.LeftParen) {
+		p.consume(token.Identifier, "expect exception variable name")
+		p.declareVariable()
+		p.markInitialized()
+		p.consume(token.RightParen, "expect ')' after exception variable")
+	} else {
+		// the thrown value still takes up a stack slot.
+		p.addHiddenLocal(p.previous.Line)
+	}
+
+	p.consume(token.LeftBrace, "expect '{' after catch clause")
+	p.block()
+	p.endScope()
+}
+
+func (p *parser) whileStatement() {
+	loopStart := len(p.currentChunk().Code)
+
+	p.consume(token.LeftParen, "expect '(' after 'while'")
+	p.expression()
+	p.consume(token.RightParen, "expect ')' after condition")
+
+	exitJump := p.emitJump(opcode.OpJumpIfFalse, p.previous.Line)
+	p.emitOpCode(opcode.OpPop, p.previous.Line)
+	p.statement()
+	p.emitLoop(loopStart, p.previous.Line)
+
+	p.patchJump(exitJump)
+	p.emitOpCode(opcode.OpPop, p.previous.Line)
+}
+
+func (p *parser) forStatement() {
+	p.beginScope()
+	p.consume(token.LeftParen, "expect '(' after 'for'")
+
+	// a for-in loop is told apart from one with an initializer by the 'in' after its variable.
+	isVar := p.match(token.Var)
+	if p.check(token.Identifier) && p.scan.Clone().ScanToken().Type == token.In {
+		p.forInLoop()
+	} else {
+		p.forLoop(isVar)
+	}
+
+	p.endScope()
+}
+
+// forLoop compiles the clauses and body of a C-style for loop. isVar is set when the 'var' of
+// the initializer has already been consumed.
+func (p *parser) forLoop(isVar bool) {
+	switch {
+	case isVar:
+		p.varDeclaration()
+	case p.match(token.Semicolon):
+		// no initializer
+	default:
+		p.expressionStatement()
+	}
+
+	loopStart := len(p.currentChunk().Code)
+
+	exitJump := -1
+	if !p.match(token.Semicolon) {
+		p.expression()
+		p.consume(token.Semicolon, "expect ';' after loop condition")
+
+		exitJump = p.emitJump(opcode.OpJumpIfFalse, p.previous.Line)
+		p.emitOpCode(opcode.OpPop, p.previous.Line)
+	}
+
+	if !p.match(token.RightParen) {
+		bodyJump := p.emitJump(opcode.OpJump, p.previous.Line)
+		incrementStart := len(p.currentChunk().Code)
+
+		p.expression()
+		p.emitOpCode(opcode.OpPop, p.previous.Line)
+		p.consume(token.RightParen, "expect ')' after for clauses")
+
+		p.emitLoop(loopStart, p.previous.Line)
+		loopStart = incrementStart
+		p.patchJump(bodyJump)
+	}
+
+	p.statement()
+	p.emitLoop(loopStart, p.previous.Line)
+
+	if exitJump != -1 {
+		p.patchJump(exitJump)
+		p.emitOpCode(opcode.OpPop, p.previous.Line)
+	}
+}
+
+// forInLoop compiles a for-in loop. The iterable and the loop's progress through it are kept in
+// three hidden locals, and every iteration binds the next element to a fresh loop variable so
+// closures capture the element of their own iteration.
+func (p *parser) forInLoop() {
+	p.consume(token.Identifier, "expect loop variable name")
+	name := p.previous
+
+	p.consume(token.In, "expect 'in' after loop variable")
+	p.expression()
+	p.consume(token.RightParen, "expect ')' after for-in iterable")
+
+	line := p.previous.Line
+	slot := len(p.compiler.locals)
+
+	p.emitOpCode(opcode.OpIterInit, line)
+	p.addHiddenLocal(line)
+	p.emitOpCode(opcode.OpNil, line) // cursor
+	p.addHiddenLocal(line)
+	p.emitOpCode(opcode.OpNil, line) // version
+	p.addHiddenLocal(line)
+
+	loopStart := len(p.currentChunk().Code)
+
+	p.emitOpCode(opcode.OpForIter, line)
+	p.emitByte(byte(slot), line)
+	exitJump := len(p.currentChunk().Code)
+	p.emitWord(math.MaxUint16, line)
+
+	p.beginScope()
+	p.addLocal(name)
+	p.markInitialized()
+	p.statement()
+	p.endScope()
+
+	p.emitLoop(loopStart, p.previous.Line)
+	p.patchJump(exitJump)
+}
+
+// addHiddenLocal declares a local for a value the compiler keeps on the stack, which can't be
+// referenced by name.
+func (p *parser) addHiddenLocal(line int) {
+	p.addLocal(token.Token{Type: token.Identifier, Str: "", Line: line, Literal: ""})
+	p.markInitialized()
+}
+
+func (p *parser) expressionStatement() {
+	p.expression()
+	p.consume(token.Semicolon, "expect ';' after expression")
+	p.emitOpCode(opcode.OpPop, p.previous.Line)
+}
+
+func (p *parser) call() {
+	p.compiler.temporaries++ // the callee
+	argCount := p.argumentList()
+	p.compiler.temporaries--
+
+	p.compiler.lastCall = len(p.currentChunk().Code)
+	p.emitOpCode(opcode.OpCall, p.previous.Line)
+	p.emitByte(byte(argCount), p.previous.Line)
+}
+
+func (p *parser) argumentList() int {
+	argCount := 0
+
+	if !p.check(token.RightParen) {
+		for {
+			p.expression()
+
+			if argCount == maxArguments {
+				p.errorAtPrevious("can't have more than %d arguments", maxArguments)
+			}
+
+			argCount++
+			p.compiler.temporaries++
+
+			if !p.match(token.Comma) {
+				break
+			}
+		}
+	}
+
+	p.compiler.temporaries -= argCount
+	p.consume(token.RightParen, "expect ')' after arguments")
+
+	return argCount
+}
+
+// selectChannels compiles a select, which waits until one of the channels it's given has a
+// value to receive.
+func (p *parser) selectChannels() {
+	line := p.previous.Line
+
+	p.consume(token.LeftParen, "expect '(' after 'select'")
+	count := p.argumentList()
+
+	p.emitOpCode(opcode.OpSelect, line)
+	p.emitByte(byte(count), line)
+}
+
+// matchExpression compiles a match in line. The value being matched is kept in a hidden local
+// in the slot the match leaves its result in, and the variables its patterns bind are locals of
+// their arm. Arms test the value in order, and the first that fits replaces it with the value
+// of its expression.
+func (p *parser) matchExpression() {
+	base := len(p.compiler.locals)
+	temporaries := p.compiler.temporaries
+
+	// the value goes on top of whatever the expression around the match keeps on the stack,
+	// which takes up hidden locals while the arms are compiled. A variable being declared has
+	// no value on the stack yet, and its slot is taken by the value being matched.
+	subject := base + temporaries
+	if base > 0 && p.compiler.locals[base-1].depth == uninitializedDepth {
+		subject--
+	}
+
+	p.expression()
+	p.consume(token.LeftBrace, "expect '{' after match value")
+
+	p.beginScope()
+
+	for len(p.compiler.locals) <= subject {
+		p.addHiddenLocal(p.previous.Line)
+	}
+
+	p.compiler.temporaries = 0
+
+	var ends []int
+
+	for !p.check(token.RightBrace) && !p.check(token.EOF) {
+		ends = append(ends, p.matchArm(subject))
+
+		if !p.match(token.Comma) {
+			break
+		}
+	}
+
+	p.consume(token.RightBrace, "expect '}' after match arms")
+
+	p.emitGetLocal(subject, p.previous.Line)
+	p.emitOpCode(opcode.OpNoMatch, p.previous.Line)
+
+	for _, end := range ends {
+		p.patchJump(end)
+	}
+
+	// the hidden locals are left on the stack, the value being matched as the result.
+	p.compiler.scopeDepth--
+
+	for n := len(p.compiler.locals); n > base; n-- {
+		p.currentChunk().EndLocal(n-1, len(p.currentChunk().Code))
+	}
+
+	p.compiler.locals = p.compiler.locals[:base]
+	p.compiler.temporaries = temporaries
+}
+
+// matchArm compiles an arm of a match testing the value in slot subject, returning the jump
+// to the end of the match an arm that fits takes once its value is in place of the subject.
+// The jumps out of an arm that doesn't fit land on a run of pops clearing what it left on the
+// stack, which falls through to the next arm.
+func (p *parser) matchArm(subject int) int {
+	arm := &matchArm{base: len(p.compiler.locals), fails: nil}
+
+	p.beginScope()
+	p.pattern(arm, subject)
+
+	if p.match(token.If) {
+		p.compiler.guardParen = p.check(token.LeftParen)
+		p.expression()
+		p.matchTest(arm)
+	}
+
+	p.consume(token.EqualGreater, "expect '=>' after pattern")
+	p.expression()
+
+	p.emitOpCode(opcode.OpSetLocal, p.previous.Line)
+	p.emitByte(byte(subject), p.previous.Line)
+	p.emitOpCode(opcode.OpPop, p.previous.Line)
+
+	for depth := len(p.compiler.locals) - arm.base; depth > 0; depth-- {
+		p.emitMatchPop(arm, depth)
+	}
+
+	end := p.emitJump(opcode.OpJump, p.previous.Line)
+
+	sort.SliceStable(arm.fails, func(i, j int) bool { return arm.fails[i].depth > arm.fails[j].depth })
+
+	depth := 0
+	for _, fail := range arm.fails {
+		for ; depth > fail.depth; depth-- {
+			p.emitMatchPop(arm, depth)
+		}
+
+		depth = fail.depth
+		p.patchJump(fail.offset)
+	}
+
+	for ; depth > 0; depth-- {
+		p.emitMatchPop(arm, depth)
+	}
+
+	// both ways out of the arm have cleared its locals already.
+	p.compiler.scopeDepth--
+
+	for n := len(p.compiler.locals); n > arm.base; n-- {
+		p.currentChunk().EndLocal(n-1, len(p.currentChunk().Code))
+	}
+
+	p.compiler.locals = p.compiler.locals[:arm.base]
+
+	return end
+}
+
+// emitMatchPop pops the value depth slots above the locals arm started with, closing it over if
+// it's a local that was captured.
+func (p *parser) emitMatchPop(arm *matchArm, depth int) {
+	if slot := arm.base + depth - 1; slot < len(p.compiler.locals) && p.compiler.locals[slot].isCaptured {
+		p.emitOpCode(opcode.OpCloseUpvalue, p.previous.Line)
+	} else {
+		p.emitOpCode(opcode.OpPop, p.previous.Line)
+	}
+}
+
+// matchTest leaves arm if the test result on top of the stack is false, and pops it otherwise.
+func (p *parser) matchTest(arm *matchArm) {
+	depth := len(p.compiler.locals) - arm.base + 1
+
+	arm.fails = append(arm.fails, matchFail{offset: p.emitJump(opcode.OpJumpIfFalse, p.previous.Line), depth: depth})
+	p.emitOpCode(opcode.OpPop, p.previous.Line)
+}
+
+// pattern compiles a pattern testing the value in slot. Names in the pattern are bound to the
+// parts of the value they stand for, as locals of the arm.
+func (p *parser) pattern(arm *matchArm, slot int) {
+	switch {
+	case p.match(token.LeftBracket):
+		p.listPattern(arm, slot)
+	case p.match(token.LeftBrace):
+		p.mapPattern(arm, slot)
+	case p.match(token.Identifier):
+		name := p.previous
+
+		switch {
+		case name.Str == wildcardName:
+		case p.match(token.LeftBrace):
+			p.classPattern(arm, slot, name)
+		default:
+			p.emitGetLocal(slot, name.Line)
+			p.declareVariable()
+			p.markInitialized()
+		}
+	default:
+		p.literalPattern(arm, slot)
+	}
+}
+
+// subpattern compiles the pattern for a part of the value being tested, which fetch pushes
+// onto the stack unless the pattern is a wildcard.
+func (p *parser) subpattern(arm *matchArm, fetch func()) {
+	if p.check(token.Identifier) && p.current.Str == wildcardName {
+		p.advance()
+
+		return
+	}
+
+	fetch()
+
+	slot := len(p.compiler.locals)
+	p.addHiddenLocal(p.previous.Line)
+	p.pattern(arm, slot)
+}
+
+// literalPattern compiles a literal, which fits values equal to it, or a range of numbers.
+func (p *parser) literalPattern(arm *matchArm, slot int) {
+	line := p.current.Line
+
+	p.emitGetLocal(slot, line)
+
+	start := p.patternLiteral()
+	p.emitConstant(start, line)
+
+	if p.match(token.DotDot) {
+		end := p.patternLiteral()
+		if !start.IsNumeric() || !end.IsNumeric() {
+			p.errorAtPrevious("range pattern bounds must be numbers")
+		}
+
+		p.emitConstant(end, line)
+		p.emitOpCode(opcode.OpMatchRange, line)
+	} else {
+		p.emitOpCode(opcode.OpEqual, line)
+	}
+
+	p.matchTest(arm)
+}
+
+// patternLiteral consumes the literal in a pattern and returns its value.
+func (p *parser) patternLiteral() value.Value {
+	negate := p.match(token.Minus)
+
+	switch {
+	case p.match(token.Number):
+		val, _ := p.numberValue()
+
+		switch {
+		case !negate:
+		case val.IsInt():
+			val = value.NewInt(-val.AsInt())
+		default:
+			val = value.NewNumber(-val.AsNumber())
+		}
+
+		return val
+	case negate:
+	case p.match(token.String):
+		return value.NewObj(p.vm.internString(p.previous.Literal))
+	case p.match(token.True):
+		return value.NewBool(true)
+	case p.match(token.False):
+		return value.NewBool(false)
+	case p.match(token.Nil):
+		return value.NewNil()
+	}
+
+	p.errorAtCurrent("expect pattern")
+
+	return value.NewNil()
+}
+
+// listPattern compiles a list pattern, which fits lists with as many elements as it has
+// patterns, each fitting its element.
+func (p *parser) listPattern(arm *matchArm, slot int) {
+	line := p.previous.Line
+
+	p.emitGetLocal(slot, line)
+	p.emitOpCode(opcode.OpMatchList, line)
+	countOffset := len(p.currentChunk().Code)
+	p.emitWord(0, line)
+	p.matchTest(arm)
+
+	count := 0
+
+	if !p.check(token.RightBracket) {
+		for {
+			index := count
+			p.subpattern(arm, func() {
+				p.emitGetLocal(slot, line)
+				p.emitConstant(value.NewInt(int64(index)), line)
+				p.emitOpCode(opcode.OpIndexGet, line)
+			})
+
+			if count == maxElements {
+				p.errorAtPrevious("can't have more than %d elements in a list pattern", maxElements)
+			}
+
+			count++
+
+			if !p.match(token.Comma) {
+				break
+			}
+		}
+	}
+
+	p.consume(token.RightBracket, "expect ']' after list pattern")
+
+	p.currentChunk().Code[countOffset] = uint8((count >> 8) & 0xff)
+	p.currentChunk().Code[countOffset+1] = uint8(count & 0xff)
+}
+
+// mapPattern compiles a map pattern, which fits maps that have each of its keys with a value
+// fitting the key's pattern. Other keys are ignored.
+func (p *parser) mapPattern(arm *matchArm, slot int) {
+	line := p.previous.Line
+	hasID := p.identifierConstant(token.Token{Type: token.Identifier, Str: "has", Line: line, Literal: ""})
+
+	p.emitGetLocal(slot, line)
+	p.emitOpCode(opcode.OpMatchMap, line)
+	p.matchTest(arm)
+
+	if !p.check(token.RightBrace) {
+		for {
+			key := p.patternLiteral()
+			p.consume(token.Colon, "expect ':' after map pattern key")
+
+			p.emitGetLocal(slot, line)
+			p.emitConstant(key, line)
+			p.emitNameOp(opcode.OpInvoke, hasID, line)
+			p.emitByte(1, line)
+			p.matchTest(arm)
+
+			p.subpattern(arm, func() {
+				p.emitGetLocal(slot, line)
+				p.emitConstant(key, line)
+				p.emitOpCode(opcode.OpIndexGet, line)
+			})
+
+			if !p.match(token.Comma) {
+				break
+			}
+		}
+	}
+
+	p.consume(token.RightBrace, "expect '}' after map pattern")
+}
+
+// classPattern compiles a class pattern, which fits instances of the class or its subclasses
+// that have each of its fields. A field on its own binds a variable of the same name, and one
+// followed by a pattern must fit it.
+func (p *parser) classPattern(arm *matchArm, slot int, class token.Token) {
+	p.emitGetLocal(slot, class.Line)
+	p.namedVariable(class, false)
+	p.emitOpCode(opcode.OpMatchClass, class.Line)
+	p.matchTest(arm)
+
+	if !p.check(token.RightBrace) {
+		for {
+			p.consume(token.Identifier, "expect field name")
+			field := p.previous
+			fieldID := p.identifierConstant(field)
+
+			p.emitGetLocal(slot, field.Line)
+			p.emitNameOp(opcode.OpMatchField, fieldID, field.Line)
+			p.matchTest(arm)
+
+			fetch := func() {
+				p.emitGetLocal(slot, field.Line)
+				p.emitNameOp(opcode.OpGetProperty, fieldID, field.Line)
+			}
+
+			if p.match(token.Colon) {
+				p.subpattern(arm, fetch)
+			} else {
+				fetch()
+				p.declareVariable()
+				p.markInitialized()
+			}
+
+			if !p.match(token.Comma) {
+				break
+			}
+		}
+	}
+
+	p.consume(token.RightBrace, "expect '}' after class pattern fields")
+}
+
+func (p *parser) list() {
+	line := p.previous.Line
+	count := 0
+
+	if !p.check(token.RightBracket) {
+		for {
+			p.expression()
+
+			if count == maxElements {
+				p.errorAtPrevious("can't have more than %d elements in a list literal", maxElements)
+			}
+
+			count++
+			p.compiler.temporaries++
+
+			if !p.match(token.Comma) {
+				break
+			}
+		}
+	}
+
+	p.compiler.temporaries -= count
+	p.consume(token.RightBracket, "expect ']' after list elements")
+
+	p.emitOpCode(opcode.OpBuildList, line)
+	p.emitWord(uint16(count), line)
+}
+
+// mapLiteral compiles a map literal. A '{' only starts a map where an expression is expected,
+// a '{' starting a statement is always a block.
+func (p *parser) mapLiteral() {
+	line := p.previous.Line
+	count := 0
+
+	if !p.check(token.RightBrace) {
+		for {
+			p.expression()
+			p.compiler.temporaries++
+			p.consume(token.Colon, "expect ':' after map key")
+			p.expression()
+			p.compiler.temporaries++
+
+			if count == maxElements {
+				p.errorAtPrevious("can't have more than %d entries in a map literal", maxElements)
+			}
+
+			count++
+
+			if !p.match(token.Comma) {
+				break
+			}
+		}
+	}
+
+	p.compiler.temporaries -= 2 * count
+	p.consume(token.RightBrace, "expect '}' after map entries")
+
+	p.emitOpCode(opcode.OpBuildMap, line)
+	p.emitWord(uint16(count), line)
+}
+
+func (p *parser) index(canAssign bool) {
+	line := p.previous.Line
+
+	p.compiler.temporaries++ // the indexed value
+	p.expression()
+	p.consume(token.RightBracket, "expect ']' after index")
+
+	if canAssign && p.match(token.Equal) {
+		p.compiler.temporaries++ // the index
+		p.expression()
+		p.compiler.temporaries--
+		p.emitOpCode(opcode.OpIndexSet, line)
+	} else {
+		p.emitOpCode(opcode.OpIndexGet, line)
+	}
+
+	p.compiler.temporaries--
+}
+
+func (p *parser) dot(canAssign bool) {
+	p.consume(token.Identifier, "expect property name after '.'")
+	name := p.previous
+	nameID := p.identifierConstant(name)
+
+	p.compiler.temporaries++ // the object
+
+	switch {
+	case canAssign && p.match(token.Equal):
+		p.expression()
+		p.emitNameOp(opcode.OpSetProperty, nameID, name.Line)
+	case p.match(token.LeftParen):
+		argCount := p.argumentList()
+		p.compiler.lastCall = len(p.currentChunk().Code)
+		p.emitNameOp(opcode.OpInvoke, nameID, name.Line)
+		p.emitByte(byte(argCount), name.Line)
+	default:
+		p.emitNameOp(opcode.OpGetProperty, nameID, name.Line)
+	}
+
+	p.compiler.temporaries--
+}
+
+func (p *parser) expression() {
+	p.parsePrecedence(assignmentPrecedence)
+}
+
+// parenthesized compiles an expression starting with '(', which opens either a grouping or the
+// parameter list of an arrow function.
+func (p *parser) parenthesized() {
+	guardParen := p.compiler.guardParen
+	p.compiler.guardParen = false
+
+	if !guardParen && p.isArrowFunction() {
+		p.arrowFunction()
+	} else {
+		p.grouping()
+	}
+}
+
+// isArrowFunction reports whether the '(' just consumed opens the parameter list of an arrow
+// function, looking ahead with a copy of the scanner for a list of names followed by '=>'.
+func (p *parser) isArrowFunction() bool {
+	scan := p.scan.Clone()
+	tok := p.current
+
+	for tok.Type == token.Identifier {
+		if tok = scan.ScanToken(); tok.Type != token.Comma {
+			break
+		}
+
+		tok = scan.ScanToken()
+	}
+
+	return tok.Type == token.RightParen && scan.ScanToken().Type == token.EqualGreater
+}
+
+func (p *parser) grouping() {
+	p.expression()
+
+	p.consume(token.RightParen, "expected ')' after expression")
+}
+
+func (p *parser) and() {
+	endJump := p.emitJump(opcode.OpJumpIfFalse, p.previous.Line)
+
+	p.emitOpCode(opcode.OpPop, p.previous.Line)
+	p.parsePrecedence(andPrecedence)
+
+	p.patchJump(endJump)
+}
+
+func (p *parser) or() {
+	elseJump := p.emitJump(opcode.OpJumpIfFalse, p.previous.Line)
+	endJump := p.emitJump(opcode.OpJump, p.previous.Line)
+
+	p.patchJump(elseJump)
+	p.emitOpCode(opcode.OpPop, p.previous.Line)
+	p.parsePrecedence(orPrecedence)
+
+	p.patchJump(endJump)
+}
+
+func (p *parser) literal() {
+	//nolint:exhaustive // we only care about a couple of token types
+	switch p.previous.Type {
+	case token.False:
+		p.emitOpCode(opcode.OpFalse, p.previous.Line)
+	case token.Nil:
+		p.emitOpCode(opcode.OpNil, p.previous.Line)
+	case token.True:
+		p.emitOpCode(opcode.OpTrue, p.previous.Line)
+	default:
+		return
+	}
+}
+
+func (p *parser) number() {
+	if val, ok := p.numberValue(); ok {
+		p.emitConstant(val, p.previous.Line)
+	}
+}
+
+// numberValue parses the number literal just consumed, reporting whether it's valid.
+func (p *parser) numberValue() (value.Value, bool) {
+	// literals without a fractional part are integers; everything else is a float.
+	if !strings.Contains(p.previous.Str, ".") {
+		val, err := strconv.ParseInt(p.previous.Str, 10, 64)
+		if err != nil {
+			p.errorAtPrevious("integer literal out of range")
+
+			return value.NewNil(), false
+		}
+
+		return value.NewInt(val), true
+	}
+
+	val, err := strconv.ParseFloat(p.previous.Str, 64)
+	if err != nil {
+		p.errorAtCurrent("failed to parse number '%s': %v", p.previous.Str, err)
+	}
+
+	return value.NewNumber(val), true
+}
+
+func (p *parser) string() {
+	p.emitConstant(value.NewObj(p.vm.internString(p.previous.Literal)), p.previous.Line)
+}
+
+// interpolation compiles a string literal with embedded expressions into the concatenation of
+// its segments and the stringified values of its expressions.
+func (p *parser) interpolation() {
+	p.emitConstant(value.NewObj(p.vm.internString(p.previous.Literal)), p.previous.Line)
+
+	for {
+		p.compiler.temporaries++ // the string so far
+		p.expression()
+		p.compiler.temporaries--
+		p.emitOpCode(opcode.OpToString, p.previous.Line)
+		p.emitOpCode(opcode.OpAdd, p.previous.Line)
+
+		if !p.match(token.Interpolation) {
+			break
+		}
+
+		p.emitSegment()
+	}
+
+	if !p.check(token.String) {
+		p.errorAtCurrent("expect end of string interpolation")
+
+		return
+	}
+
+	p.advance()
+	p.emitSegment()
+}
+
+// emitSegment appends the string segment just consumed to the string on top of the stack.
+func (p *parser) emitSegment() {
+	if segment := p.previous.Literal; segment != "" {
+		p.emitConstant(value.NewObj(p.vm.internString(segment)), p.previous.Line)
+		p.emitOpCode(opcode.OpAdd, p.previous.Line)
+	}
+}
+
+func (p *parser) variable(canAssign bool) {
+	p.namedVariable(p.previous, canAssign)
+}
+
+func (p *parser) namedVariable(name token.Token, canAssign bool) {
+	if slot := p.resolveLocal(p.compiler, name); slot >= 0 {
+		p.emitVariableAccess(opcode.OpGetLocal, opcode.OpSetLocal, slot, name, canAssign)
+
+		return
+	}
+
+	if index := p.resolveUpvalue(p.compiler, name); index >= 0 {
+		p.emitVariableAccess(opcode.OpGetUpvalue, opcode.OpSetUpvalue, index, name, canAssign)
+
+		return
+	}
+
+	nameID := p.identifierConstant(name)
+
+	if canAssign && p.match(token.Equal) {
+		p.expression()
+		p.emitNameOp(opcode.OpSetGlobal, nameID, name.Line)
+	} else {
+		p.emitNameOp(opcode.OpGetGlobal, nameID, name.Line)
+	}
+}
+
+// emitVariableAccess emits a read of the variable with the byte operand, or an assignment to
+// it when the variable is a valid assignment target followed by '='.
+func (p *parser) emitVariableAccess(getOp, setOp opcode.OpCode, operand int, name token.Token, canAssign bool) {
+	op := getOp
+	if canAssign && p.match(token.Equal) {
+		p.expression()
+		op = setOp
+	}
+
+	p.emitOpCode(op, name.Line)
+	p.emitByte(byte(operand), name.Line)
+}
+
+func (p *parser) super() {
+	switch {
+	case p.class == nil:
+		p.errorAtPrevious("can't use 'super' outside of a class")
+	case !p.class.hasSuperclass:
+		p.errorAtPrevious("can't use 'super' in a class with no superclass")
+	}
+
+	p.consume(token.Dot, "expect '.' after 'super'")
+	p.consume(token.Identifier, "expect superclass method name")
+	name := p.previous
+	nameID := p.identifierConstant(name)
+
+	p.namedVariable(token.Token{Type: token.This, Str: "this", Line: name.Line}, false)
+
+	if p.match(token.LeftParen) {
+		p.compiler.temporaries++ // the receiver
+		argCount := p.argumentList()
+		p.compiler.temporaries--
+		p.namedVariable(token.Token{Type: token.Super, Str: "super", Line: name.Line}, false)
+		p.emitNameOp(opcode.OpSuperInvoke, nameID, name.Line)
+		p.emitByte(byte(argCount), name.Line)
+	} else {
+		p.namedVariable(token.Token{Type: token.Super, Str: "super", Line: name.Line}, false)
+		p.emitNameOp(opcode.OpGetSuper, nameID, name.Line)
+	}
+}
+
+func (p *parser) this() {
+	if p.class == nil {
+		p.errorAtPrevious("can't use 'this' outside of a class")
+
+		return
 	}
 
-	p.emitConstant(value.Value(val), p.previous.Line)
+	p.namedVariable(p.previous, false)
 }
 
 func (p *parser) unary() {
@@ -187,8 +1848,12 @@ func (p *parser) unary() {
 
 	//nolint:exhaustive // we only care about a couple of token types
 	switch operatorType {
+	case token.Bang:
+		p.emitOpCode(opcode.OpNot, p.previous.Line)
 	case token.Minus:
 		p.emitOpCode(opcode.OpNegate, p.previous.Line)
+	case token.Tilde:
+		p.emitOpCode(opcode.OpBitNot, p.previous.Line)
 	default:
 	}
 }
@@ -215,18 +1880,17 @@ func (p *parser) errorAtToken(t token.Token, msg string, args ...any) {
 	//nolint:exhaustive // we only care about a couple of token types
 	switch t.Type {
 	case token.EOF:
-		fmt.Fprintf(os.Stderr, " at end")
+		fmt.Fprintf(&buf, " at end")
 	case token.Error:
 		break
 	default:
-		fmt.Fprintf(os.Stderr, " at '%v'", fmt.Sprintf(msg, args...))
+		fmt.Fprintf(&buf, " at '%s'", t.Str)
 	}
 
 	fmt.Fprintf(&buf, ": ")
 	fmt.Fprintf(&buf, msg, args...)
 
-	p.err = fmt.Errorf(buf.String())
-	fmt.Fprint(os.Stderr, p.err.Error())
+	p.err = errors.New(buf.String())
 }
 
 func (p *parser) Err() error {
@@ -0,0 +1,93 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type (
+	// RuntimeError is returned by the VM when a program fails during execution.
+	RuntimeError struct {
+		Message string
+		Line    int
+		Trace   []TraceEntry
+	}
+
+	// TraceEntry is a single call-stack entry of a RuntimeError, innermost call first.
+	TraceEntry struct {
+		Function string
+		Line     int
+	}
+)
+
+var (
+	// ErrStackUnderflow is raised when an instruction pops more values than the stack holds.
+	ErrStackUnderflow = errors.New("stack underflow")
+
+	// ErrStackOverflow is raised when an instruction pushes onto a full stack.
+	ErrStackOverflow = errors.New("stack overflow")
+
+	// ErrNoFileSystem is returned when loading a script from a VM created without WithFS.
+	ErrNoFileSystem = errors.New("no file system to load scripts from")
+)
+
+func (e *RuntimeError) Error() string {
+	var buf strings.Builder
+
+	fmt.Fprintf(&buf, "runtime error: %s", e.Message)
+
+	for _, entry := range e.Trace {
+		fmt.Fprintf(&buf, "\n%s", entry)
+	}
+
+	return buf.String()
+}
+
+func (e TraceEntry) String() string {
+	return fmt.Sprintf("[line %d] in %s", e.Line, e.Function)
+}
+
+// runtimeError builds a RuntimeError for the instruction currently executing in every active
+// call frame. Unless a handler catches it, the error stops the VM.
+func (v *VM) runtimeError(msg string, args ...any) error {
+	err := &RuntimeError{
+		Message: fmt.Sprintf(msg, args...),
+		Line:    0,
+		Trace:   v.stackTrace(),
+	}
+
+	if len(err.Trace) > 0 {
+		err.Line = err.Trace[0].Line
+	}
+
+	return err
+}
+
+// stackTrace lists the instruction currently executing in every active call frame, innermost
+// first. The top-level code of imported modules is named after the module's path.
+func (v *VM) stackTrace() []TraceEntry {
+	trace := make([]TraceEntry, 0, len(v.Frames))
+
+	for i := len(v.Frames) - 1; i >= 0; i-- {
+		frame := &v.Frames[i]
+		function := frame.Closure.Function
+
+		line := 0
+		if offset := frame.IP - 1; offset >= 0 && offset < len(function.Chunk.Lines) {
+			line = function.Chunk.Lines[offset]
+		}
+
+		name := "script"
+		switch {
+		case function.Name != nil:
+			name = function.Name.Chars + "()"
+		case function.Module != v.main && function.Module.Path != "":
+			name += " " + function.Module.Path
+		}
+
+		trace = append(trace, TraceEntry{Function: name, Line: line})
+	}
+
+	return trace
+}
@@ -0,0 +1,220 @@
+package vm
+
+import (
+	"github.com/meanguy/automato/internal/object"
+	"github.com/meanguy/automato/internal/value"
+)
+
+type (
+	// handler is an active catch or finally clause. Throwing unwinds the VM back to the call
+	// frame and stack height the handler was pushed at, then jumps to ip.
+	handler struct {
+		finally  bool
+		frames   int
+		stackTop int
+		ip       int
+	}
+)
+
+// Completion kinds a finally clause is entered with, telling OpEndFinally how to resume once
+// the clause is done.
+const (
+	completionNormal int64 = iota
+	completionThrow
+	completionReturn
+)
+
+// prelude defines the classes every VM starts out with. Runtime errors the VM raises itself
+// are instances of Error, which scripts can subclass for their own errors.
+const prelude = `
+class Error {
+  init(message) {
+    this.message = message;
+  }
+}
+`
+
+const (
+	errorClassName    = "Error"
+	errorMessageField = "message"
+	errorTraceField   = "trace"
+)
+
+// loadPrelude runs the prelude, whose globals are built in to every module. It doesn't show up
+// in debug output.
+func (v *VM) loadPrelude() {
+	v.messageString = v.internString(errorMessageField)
+	v.traceString = v.internString(errorTraceField)
+
+	debug := v.Debug
+	v.Debug = false
+
+	function, err := v.compile(prelude, v.builtins)
+	if err == nil {
+		err = v.interpretFunction(function)
+	}
+
+	if err != nil {
+		panic(err)
+	}
+
+	v.Debug = debug
+
+	v.errorClass, _ = v.builtins.Globals[v.internString(errorClassName)].AsObj().(*object.Class)
+}
+
+func (v *VM) pushHandler(finally bool) {
+	offset := int(v.readWord())
+
+	v.handlers = append(v.handlers, handler{
+		finally:  finally,
+		frames:   len(v.Frames),
+		stackTop: len(v.Stack),
+		ip:       v.frame().IP + offset,
+	})
+}
+
+// unwind returns the VM to the state h was pushed in and jumps to it.
+func (v *VM) unwind(h handler) {
+	v.closeUpvalues(h.stackTop)
+	v.discardFrames(h.frames)
+	v.Stack = v.Stack[:h.stackTop]
+	v.frame().IP = h.ip
+}
+
+// throw hands val to the innermost handler, reporting whether there was one.
+func (v *VM) throw(val value.Value) bool {
+	if !v.enterHandler() {
+		return false
+	}
+
+	v.Push(val)
+
+	return true
+}
+
+// enterHandler pops the innermost handler and unwinds to it, leaving the stack ready for the
+// thrown value to be pushed. It reports whether there was a handler.
+func (v *VM) enterHandler() bool {
+	if len(v.handlers) == 0 {
+		return false
+	}
+
+	h := v.handlers[len(v.handlers)-1]
+	v.handlers = v.handlers[:len(v.handlers)-1]
+	v.unwind(h)
+
+	if h.finally {
+		v.Push(value.NewInt(completionThrow))
+	}
+
+	return true
+}
+
+// throwValue throws val from a throw statement. Errors are given the stack trace of the throw
+// statement unless they already carry one.
+func (v *VM) throwValue(val value.Value) error {
+	if instance, ok := v.asError(val); ok {
+		if _, ok := instance.Fields[v.traceString]; !ok {
+			v.Push(val) // the trace allocates
+			v.setErrorTrace(instance, v.stackTrace())
+			v.Pop()
+		}
+	}
+
+	if v.throw(val) {
+		return nil
+	}
+
+	return v.uncaught(val)
+}
+
+// catch throws err, which the VM raised itself, as an Error to the innermost handler,
+// reporting whether there was one. The VM unwinds before creating the Error, as err may be a
+// stack overflow leaving no room for it.
+func (v *VM) catch(err *RuntimeError) bool {
+	if v.errorClass == nil || !v.enterHandler() {
+		return false
+	}
+
+	instance := v.newInstance(v.errorClass)
+	v.Push(value.NewObj(instance))
+	instance.Fields[v.messageString] = value.NewObj(v.internString(err.Message))
+	v.setErrorTrace(instance, err.Trace)
+
+	return true
+}
+
+// enterFinally jumps to the innermost finally clause of the current call frame so it runs
+// before the frame returns result, reporting whether there was one. Catch clauses on the way
+// are discarded.
+func (v *VM) enterFinally(result value.Value) bool {
+	for len(v.handlers) > 0 && v.handlers[len(v.handlers)-1].frames == len(v.Frames) {
+		h := v.handlers[len(v.handlers)-1]
+		v.handlers = v.handlers[:len(v.handlers)-1]
+
+		if h.finally {
+			v.unwind(h)
+			v.Push(value.NewInt(completionReturn))
+			v.Push(result)
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// endFinally resumes whatever completion the finally clause that just ended interrupted,
+// reporting whether the script returned.
+func (v *VM) endFinally() (bool, error) {
+	val := v.Pop()
+
+	switch v.Pop().AsInt() {
+	case completionThrow:
+		if !v.throw(val) {
+			return false, v.uncaught(val)
+		}
+	case completionReturn:
+		return v.returnFrom(val), nil
+	}
+
+	return false, nil
+}
+
+// uncaught builds the error Interpret returns when nothing catches val.
+func (v *VM) uncaught(val value.Value) error {
+	if instance, ok := v.asError(val); ok {
+		if message, ok := instance.Fields[v.messageString]; ok {
+			return v.runtimeError("%s", message)
+		}
+	}
+
+	return v.runtimeError("uncaught exception: %s", val)
+}
+
+// asError returns val as an instance of Error or one of its subclasses.
+func (v *VM) asError(val value.Value) (*object.Instance, bool) {
+	instance, ok := asInstance(val)
+	if !ok {
+		return nil, false
+	}
+
+	for class := instance.Class; class != nil; class = class.Superclass {
+		if class == v.errorClass {
+			return instance, true
+		}
+	}
+
+	return nil, false
+}
+
+// setErrorTrace stores trace on instance as a list of strings. instance must be reachable.
+func (v *VM) setErrorTrace(instance *object.Instance, trace []TraceEntry) {
+	list := v.newList(make([]value.Value, 0, len(trace)))
+	instance.Fields[v.traceString] = value.NewObj(list)
+
+	for _, entry := range trace {
+		list.Elements = append(list.Elements, value.NewObj(v.internString(entry.String())))
+	}
+}
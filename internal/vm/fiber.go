@@ -0,0 +1,253 @@
+package vm
+
+import (
+	"errors"
+	"math"
+
+	"github.com/meanguy/automato/internal/object"
+	"github.com/meanguy/automato/internal/value"
+)
+
+type (
+	// fiber is a thread of execution with a stack, call frames, exception handlers and open
+	// upvalues of its own. The VM runs one fiber at a time and keeps the state of the running
+	// fiber in its own fields, so a fiber only holds its state while it's switched out.
+	fiber struct {
+		stack        []value.Value
+		frames       []CallFrame
+		handlers     []handler
+		openUpvalues *object.Upvalue
+		state        fiberState
+
+		// a spawned fiber starts by calling the value below argCount arguments on its stack,
+		// or by invoking method on it. argCount is -1 once the fiber has started.
+		method   *object.String
+		argCount int
+
+		// generator is set when the fiber runs a generator function. The fiber steps aside for
+		// the others whenever the generator yields, and finishes once it's done.
+		generator *generator
+
+		// wait counts the times the fiber blocked, telling its current waits apart from stale
+		// ones left behind in channels by a select.
+		wait int
+
+		// err is raised in the fiber once it wakes up, if it's set.
+		err string
+	}
+
+	fiberState int
+)
+
+const (
+	fiberReady fiberState = iota + 1
+	fiberRunning
+	fiberBlocked
+	fiberDone
+)
+
+// A spawned fiber starts out with room for a few call frames and the locals of one function,
+// and grows its stack as it needs to, up to StackMax.
+const (
+	fiberFrames = 8
+	fiberStack  = math.MaxUint8 + 1
+)
+
+// errSuspended is returned by instructions that suspend the running fiber, handing control
+// back to the scheduler.
+var errSuspended = errors.New("fiber suspended")
+
+func newFiber() *fiber {
+	return &fiber{
+		stack:        make([]value.Value, 0, fiberStack),
+		frames:       make([]CallFrame, 0, fiberFrames),
+		handlers:     nil,
+		openUpvalues: nil,
+		state:        fiberReady,
+		method:       nil,
+		argCount:     -1,
+		generator:    nil,
+		wait:         0,
+		err:          "",
+	}
+}
+
+// spawn moves the callee and its arguments on top of the stack to a new fiber, which calls it
+// once it's scheduled. If method is set it's invoked on the callee instead.
+func (v *VM) spawn(method *object.String, argCount int) {
+	f := newFiber()
+	f.method = method
+	f.argCount = argCount
+
+	base := len(v.Stack) - argCount - 1
+	f.stack = append(f.stack, v.Stack[base:]...)
+	v.Stack = v.Stack[:base]
+
+	v.fibers = append(v.fibers, f)
+	v.ready = append(v.ready, f)
+}
+
+// switchFiber saves the state of the running fiber and makes f the running fiber.
+func (v *VM) switchFiber(f *fiber) {
+	if f == v.fiber {
+		return
+	}
+
+	cur := v.fiber
+	cur.stack, cur.frames, cur.handlers, cur.openUpvalues = v.Stack, v.Frames, v.handlers, v.openUpvalues
+
+	v.Stack, v.Frames, v.handlers, v.openUpvalues = f.stack, f.frames, f.handlers, f.openUpvalues
+	f.stack, f.frames, f.handlers, f.openUpvalues = nil, nil, nil, nil
+
+	v.fiber = f
+}
+
+// step runs the running fiber until it finishes, suspends or raises an error, returning nil
+// once it's finished.
+func (v *VM) step() error {
+	f := v.fiber
+
+	if f.err != "" {
+		msg := f.err
+		f.err = ""
+
+		return v.runtimeError("%s", msg)
+	}
+
+	if f.argCount >= 0 {
+		if err := v.startFiber(f); err != nil {
+			return err
+		}
+	}
+
+	if len(v.Frames) == 0 {
+		gen := f.generator
+		if gen == nil || gen.state == generatorDone {
+			return nil
+		}
+
+		v.Push(value.NewObj(gen))
+
+		if err := v.resumeGenerator(gen, 0); err != nil {
+			return err
+		}
+	}
+
+	return v.execute()
+}
+
+// startFiber makes the call f was spawned with. Calling a generator function only creates the
+// generator, which the fiber then runs itself.
+func (v *VM) startFiber(f *fiber) error {
+	argCount := f.argCount
+	f.argCount = -1
+
+	var err error
+	if f.method != nil {
+		err = v.invoke(f.method, argCount)
+	} else {
+		err = v.callValue(v.Peek(argCount), argCount)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if gen, ok := asGenerator(v.Peek(0)); ok && len(v.Frames) == 0 {
+		f.generator = gen
+		v.Pop()
+	}
+
+	return nil
+}
+
+// yieldFiber steps aside for the other fibers after the generator the running fiber was
+// spawned with yielded val.
+func (v *VM) yieldFiber() error {
+	v.Pop() // the yielded value
+
+	v.fiber.state = fiberReady
+	v.ready = append(v.ready, v.fiber)
+
+	return errSuspended
+}
+
+// block suspends the running fiber until a channel wakes it up, returning the current wait to
+// queue on the channel.
+func (v *VM) block() int {
+	v.fiber.state = fiberBlocked
+	v.fiber.wait++
+
+	return v.fiber.wait
+}
+
+// wake schedules f, which was blocked, to run again with result in place of the slots the
+// blocking instruction operated on. If msg is set it's raised in f instead.
+func (v *VM) wake(f *fiber, slots int, result value.Value, msg string) {
+	f.stack = append(f.stack[:len(f.stack)-slots], result)
+	f.err = msg
+	f.state = fiberReady
+	v.ready = append(v.ready, f)
+}
+
+// finishFiber drops the running fiber, which just finished.
+func (v *VM) finishFiber() {
+	f := v.fiber
+	f.state = fiberDone
+	f.generator = nil
+
+	for i, other := range v.fibers {
+		if other == f {
+			v.fibers = append(v.fibers[:i], v.fibers[i+1:]...)
+
+			break
+		}
+	}
+}
+
+// schedule switches to the next fiber ready to run, reporting whether every fiber has finished.
+// If there's none but some are still blocked, they're deadlocked.
+func (v *VM) schedule() (bool, error) {
+	if len(v.ready) > 0 {
+		next := v.ready[0]
+		v.ready[0] = nil
+		v.ready = v.ready[1:]
+
+		v.switchFiber(next)
+		next.state = fiberRunning
+
+		return false, nil
+	}
+
+	if v.mainFiber.state == fiberDone && len(v.fibers) == 0 {
+		v.switchFiber(v.mainFiber)
+
+		return true, nil
+	}
+
+	// the error points at where the script is stuck, or else the oldest stuck fiber.
+	if v.mainFiber.state != fiberDone {
+		v.switchFiber(v.mainFiber)
+	} else {
+		v.switchFiber(v.fibers[0])
+	}
+
+	err := v.runtimeError("deadlock: every fiber is blocked")
+	v.resetStack()
+
+	return true, err
+}
+
+// resetFibers drops every spawned fiber along with its call frames, closing its upvalues and
+// leaving the main fiber running.
+func (v *VM) resetFibers() {
+	for _, f := range v.fibers {
+		v.switchFiber(f)
+		v.discardFrames(0)
+		v.closeUpvalues(0)
+	}
+
+	v.switchFiber(v.mainFiber)
+	v.fibers = nil
+	v.ready = nil
+}
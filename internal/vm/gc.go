@@ -0,0 +1,433 @@
+package vm
+
+import (
+	"unsafe"
+
+	"github.com/meanguy/automato/internal/object"
+	"github.com/meanguy/automato/internal/value"
+)
+
+const (
+	// initialGCThreshold is the number of bytes the heap may grow to before the first
+	// collection.
+	initialGCThreshold = 1024 * 1024
+
+	// gcHeapGrowFactor scales the threshold for the next collection by the size of the heap that
+	// survived the last one.
+	gcHeapGrowFactor = 2
+
+	// valueSize is the size of a single value stored in an object.
+	valueSize = int(unsafe.Sizeof(value.Value{}))
+
+	// tableEntrySize estimates the size of a single field or method table entry.
+	tableEntrySize = valueSize + int(unsafe.Sizeof(&object.String{}))
+
+	// mapEntrySize estimates the size of a single map entry along with its index.
+	mapEntrySize = 3*valueSize + int(unsafe.Sizeof(0))
+)
+
+// WithStressGC makes the VM collect garbage before every allocation. This is slow, but flushes
+// out objects that are still in use without being reachable from a root.
+func WithStressGC() VMOption {
+	return func(v *VM) {
+		v.stressGC = true
+	}
+}
+
+// BytesAllocated returns the estimated size of all live objects on the VM's heap.
+func (v *VM) BytesAllocated() int {
+	return v.bytesAllocated
+}
+
+// HeapObjects returns the number of objects on the VM's heap.
+func (v *VM) HeapObjects() int {
+	return len(v.objects)
+}
+
+// CollectGarbage frees every heap object that isn't reachable from the VM's roots: the stack,
+// the call frames, open upvalues, fibers, modules, and any function being compiled.
+func (v *VM) CollectGarbage() {
+	v.markRoots()
+	v.traceReferences()
+	v.removeWhiteStrings()
+	v.sweep()
+
+	v.nextGC = v.bytesAllocated * gcHeapGrowFactor
+	if v.nextGC < initialGCThreshold {
+		v.nextGC = initialGCThreshold
+	}
+}
+
+// track registers a newly allocated object with the collector. Collection happens before the
+// object is registered, so callers don't need to root it until their next allocation.
+func (v *VM) track(obj object.Obj) {
+	size := objectSize(obj)
+
+	if v.stressGC || v.bytesAllocated+size > v.nextGC {
+		v.CollectGarbage()
+	}
+
+	v.objects = append(v.objects, obj)
+	v.bytesAllocated += size
+}
+
+func (v *VM) newBoundMethod(receiver value.Value, method *object.Closure) *object.BoundMethod {
+	bound := object.NewBoundMethod(receiver, method)
+	v.track(bound)
+
+	return bound
+}
+
+func (v *VM) newChannel(capacity int) *channel {
+	c := &channel{
+		Header:    object.Header{},
+		capacity:  capacity,
+		buffer:    make([]value.Value, 0, capacity),
+		closed:    false,
+		senders:   nil,
+		receivers: nil,
+	}
+	v.track(c)
+
+	return c
+}
+
+func (v *VM) newClass(name *object.String) *object.Class {
+	class := object.NewClass(name)
+	v.track(class)
+
+	return class
+}
+
+func (v *VM) newClosure(function *object.Function) *object.Closure {
+	closure := object.NewClosure(function)
+	v.track(closure)
+
+	return closure
+}
+
+func (v *VM) newFunction() *object.Function {
+	function := object.NewFunction()
+	v.track(function)
+
+	return function
+}
+
+func (v *VM) newGenerator(closure *object.Closure) *generator {
+	gen := &generator{
+		Header:   object.Header{},
+		closure:  closure,
+		state:    generatorSuspended,
+		ip:       0,
+		slots:    nil,
+		handlers: nil,
+		upvalues: nil,
+	}
+	v.track(gen)
+
+	return gen
+}
+
+func (v *VM) newInstance(class *object.Class) *object.Instance {
+	instance := object.NewInstance(class)
+	v.track(instance)
+
+	return instance
+}
+
+func (v *VM) newList(elements []value.Value) *object.List {
+	list := object.NewList(elements)
+	v.track(list)
+
+	return list
+}
+
+func (v *VM) newMap() *object.Map {
+	m := object.NewMap()
+	v.track(m)
+
+	return m
+}
+
+func (v *VM) newModule(path string) *object.Module {
+	module := object.NewModule(path)
+	v.track(module)
+
+	return module
+}
+
+func (v *VM) newNative(name string, arity int, fn object.NativeFn) *object.Native {
+	native := object.NewNative(name, arity, fn)
+	v.track(native)
+
+	return native
+}
+
+func (v *VM) newRange(start, end int64) *object.Range {
+	r := object.NewRange(start, end)
+	v.track(r)
+
+	return r
+}
+
+func (v *VM) newUpvalue(slot int) *object.Upvalue {
+	upvalue := object.NewUpvalue(&v.Stack[slot], slot)
+	v.track(upvalue)
+
+	return upvalue
+}
+
+func (v *VM) markRoots() {
+	for _, val := range v.Stack {
+		v.markValue(val)
+	}
+
+	for i := range v.Frames {
+		v.markObject(v.Frames[i].Closure)
+
+		if v.Frames[i].generator != nil {
+			v.markObject(v.Frames[i].generator)
+		}
+	}
+
+	for upvalue := v.openUpvalues; upvalue != nil; upvalue = upvalue.Next {
+		v.markObject(upvalue)
+	}
+
+	// fibers that are switched out hold their own state.
+	v.markFiber(v.mainFiber)
+
+	for _, f := range v.fibers {
+		v.markFiber(f)
+	}
+
+	for _, module := range []*object.Module{v.builtins, v.main} {
+		if module != nil {
+			v.markObject(module)
+		}
+	}
+
+	for _, module := range v.modules {
+		v.markObject(module)
+	}
+
+	for _, str := range []*object.String{v.initString, v.iterString, v.nextString, v.messageString, v.traceString} {
+		if str != nil {
+			v.markObject(str)
+		}
+	}
+
+	if v.errorClass != nil {
+		v.markObject(v.errorClass)
+	}
+
+	if v.parser != nil {
+		for c := v.parser.compiler; c != nil; c = c.enclosing {
+			v.markObject(c.function)
+		}
+	}
+}
+
+func (v *VM) markFiber(f *fiber) {
+	for _, val := range f.stack {
+		v.markValue(val)
+	}
+
+	for i := range f.frames {
+		v.markObject(f.frames[i].Closure)
+
+		if f.frames[i].generator != nil {
+			v.markObject(f.frames[i].generator)
+		}
+	}
+
+	for upvalue := f.openUpvalues; upvalue != nil; upvalue = upvalue.Next {
+		v.markObject(upvalue)
+	}
+
+	if f.method != nil {
+		v.markObject(f.method)
+	}
+
+	if f.generator != nil {
+		v.markObject(f.generator)
+	}
+}
+
+func (v *VM) markValue(val value.Value) {
+	if !val.IsObj() {
+		return
+	}
+
+	if obj, ok := val.AsObj().(object.Obj); ok {
+		v.markObject(obj)
+	}
+}
+
+func (v *VM) markObject(obj object.Obj) {
+	if obj == nil || obj.IsMarked() {
+		return
+	}
+
+	obj.SetMarked(true)
+	v.grayStack = append(v.grayStack, obj)
+}
+
+func (v *VM) traceReferences() {
+	for len(v.grayStack) > 0 {
+		obj := v.grayStack[len(v.grayStack)-1]
+		v.grayStack = v.grayStack[:len(v.grayStack)-1]
+
+		v.blackenObject(obj)
+	}
+}
+
+// blackenObject marks every object obj refers to.
+func (v *VM) blackenObject(obj object.Obj) {
+	switch obj := obj.(type) {
+	case *object.BoundMethod:
+		v.markValue(obj.Receiver)
+		v.markObject(obj.Method)
+	case *object.Class:
+		v.markObject(obj.Name)
+		v.markTable(obj.Methods)
+
+		if obj.Superclass != nil {
+			v.markObject(obj.Superclass)
+		}
+	case *object.Closure:
+		v.markObject(obj.Function)
+
+		for _, upvalue := range obj.Upvalues {
+			if upvalue != nil {
+				v.markObject(upvalue)
+			}
+		}
+	case *object.Function:
+		if obj.Name != nil {
+			v.markObject(obj.Name)
+		}
+
+		if obj.Module != nil {
+			v.markObject(obj.Module)
+		}
+
+		for _, constant := range obj.Chunk.Constants {
+			v.markValue(constant)
+		}
+	case *object.Instance:
+		v.markObject(obj.Class)
+		v.markTable(obj.Fields)
+	case *object.List:
+		for _, element := range obj.Elements {
+			v.markValue(element)
+		}
+	case *object.Module:
+		v.markTable(obj.Globals)
+	case *object.Upvalue:
+		v.markValue(obj.Closed)
+	case *object.Map:
+		for _, entry := range obj.Entries() {
+			v.markValue(entry.Key)
+			v.markValue(entry.Value)
+		}
+	case *generator:
+		v.markObject(obj.closure)
+
+		for _, slot := range obj.slots {
+			v.markValue(slot)
+		}
+
+		for upvalue := obj.upvalues; upvalue != nil; upvalue = upvalue.Next {
+			v.markObject(upvalue)
+		}
+	case *channel:
+		for _, val := range obj.buffer {
+			v.markValue(val)
+		}
+
+		for _, w := range obj.senders {
+			v.markValue(w.value)
+		}
+	case *object.Native, *object.Range, *object.String:
+	}
+}
+
+func (v *VM) markTable(table map[*object.String]value.Value) {
+	for key, val := range table {
+		v.markObject(key)
+		v.markValue(val)
+	}
+}
+
+// removeWhiteStrings drops unmarked strings from the intern table, which only holds weak
+// references so it doesn't keep strings alive on its own.
+func (v *VM) removeWhiteStrings() {
+	for chars, str := range v.strings {
+		if !str.IsMarked() {
+			delete(v.strings, chars)
+		}
+	}
+}
+
+// sweep frees every unmarked object. Objects like instances grow after they're allocated, so
+// the size of the heap is recounted from the survivors.
+func (v *VM) sweep() {
+	live := v.objects[:0]
+	v.bytesAllocated = 0
+
+	for _, obj := range v.objects {
+		if !obj.IsMarked() {
+			continue
+		}
+
+		obj.SetMarked(false)
+		live = append(live, obj)
+		v.bytesAllocated += objectSize(obj)
+	}
+
+	// clear the tail so the backing array doesn't keep freed objects reachable.
+	for i := len(live); i < len(v.objects); i++ {
+		v.objects[i] = nil
+	}
+
+	v.objects = live
+}
+
+// objectSize estimates the number of bytes obj occupies on the heap.
+//
+//nolint:gosec // unsafe is only used to size types, never to access memory
+func objectSize(obj object.Obj) int {
+	switch obj := obj.(type) {
+	case *object.BoundMethod:
+		return int(unsafe.Sizeof(*obj))
+	case *object.Class:
+		return int(unsafe.Sizeof(*obj)) + len(obj.Methods)*tableEntrySize
+	case *object.Closure:
+		return int(unsafe.Sizeof(*obj)) + len(obj.Upvalues)*int(unsafe.Sizeof(obj))
+	case *object.Function:
+		return int(unsafe.Sizeof(*obj))
+	case *object.Instance:
+		return int(unsafe.Sizeof(*obj)) + len(obj.Fields)*tableEntrySize
+	case *object.List:
+		return int(unsafe.Sizeof(*obj)) + len(obj.Elements)*valueSize
+	case *object.Map:
+		return int(unsafe.Sizeof(*obj)) + obj.Len()*mapEntrySize
+	case *object.Module:
+		return int(unsafe.Sizeof(*obj)) + len(obj.Path) + len(obj.Globals)*tableEntrySize
+	case *object.Native:
+		return int(unsafe.Sizeof(*obj))
+	case *object.Range:
+		return int(unsafe.Sizeof(*obj))
+	case *object.String:
+		return int(unsafe.Sizeof(*obj)) + len(obj.Chars)
+	case *object.Upvalue:
+		return int(unsafe.Sizeof(*obj))
+	case *generator:
+		return int(unsafe.Sizeof(*obj)) + len(obj.slots)*valueSize
+	case *channel:
+		return int(unsafe.Sizeof(*obj)) + obj.capacity*valueSize
+	default:
+		return int(unsafe.Sizeof(obj))
+	}
+}
@@ -0,0 +1,207 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/meanguy/automato/internal/object"
+	"github.com/meanguy/automato/internal/value"
+)
+
+type (
+	// generator is a call of a function containing yield, which runs a step at a time. Between
+	// steps its call frame lives outside the VM's stack: slots holds the frame's stack slice,
+	// and the frame's exception handlers and open upvalues are kept relative to its base.
+	generator struct {
+		object.Header
+
+		closure  *object.Closure
+		state    generatorState
+		ip       int
+		slots    []value.Value
+		handlers []handler
+		upvalues *object.Upvalue
+	}
+
+	generatorState int
+)
+
+const (
+	generatorSuspended generatorState = iota + 1
+	generatorRunning
+	generatorDone
+)
+
+//nolint:gochecknoglobals // read-only lookup table
+var generatorMethods = map[string]builtinMethod[*generator]{
+	"done": {arity: 0, fn: generatorDoneMethod},
+}
+
+func (g *generator) String() string {
+	return fmt.Sprintf("<generator %s>", g.closure.Function.Name.Chars)
+}
+
+// finish marks g as done, releasing its suspended frame.
+func (g *generator) finish() {
+	g.state = generatorDone
+	g.slots = nil
+	g.handlers = nil
+	g.upvalues = nil
+}
+
+// startGenerator replaces the call to a generator function on the stack with a generator that
+// is suspended before the function's first instruction.
+func (v *VM) startGenerator(closure *object.Closure, argCount int) {
+	base := len(v.Stack) - argCount - 1
+
+	gen := v.newGenerator(closure)
+	gen.slots = append(gen.slots, v.Stack[base:]...)
+
+	v.Stack = v.Stack[:base]
+	v.Push(value.NewObj(gen))
+}
+
+// resumeGenerator replaces gen on top of the stack with a call frame continuing it from where
+// it was suspended. The value it yields next takes the generator's place once it suspends
+// again, or nil once it finishes.
+func (v *VM) resumeGenerator(gen *generator, argCount int) error {
+	if argCount != 0 {
+		return v.runtimeError("expected 0 arguments but got %d", argCount)
+	}
+
+	switch gen.state {
+	case generatorRunning:
+		return v.runtimeError("generator is already running")
+	case generatorDone:
+		v.Pop()
+		v.Push(value.NewNil())
+
+		return nil
+	case generatorSuspended:
+	}
+
+	if len(v.Frames) == FramesMax {
+		return v.runtimeError("stack overflow")
+	}
+
+	base := len(v.Stack) - 1
+	v.Stack = v.Stack[:base]
+
+	for _, slot := range gen.slots {
+		v.Push(slot)
+	}
+
+	v.Frames = append(v.Frames, CallFrame{Closure: gen.closure, IP: gen.ip, Base: base, generator: gen})
+
+	for _, h := range gen.handlers {
+		h.frames = len(v.Frames)
+		h.stackTop += base
+		v.handlers = append(v.handlers, h)
+	}
+
+	// the generator's upvalues point above every other open upvalue, so they go first.
+	if gen.upvalues != nil {
+		last := gen.upvalues
+		for upvalue := gen.upvalues; upvalue != nil; upvalue = upvalue.Next {
+			upvalue.Slot += base
+			upvalue.Location = &v.Stack[upvalue.Slot]
+			last = upvalue
+		}
+
+		last.Next = v.openUpvalues
+		v.openUpvalues = gen.upvalues
+	}
+
+	gen.state = generatorRunning
+	gen.handlers = gen.handlers[:0]
+	gen.upvalues = nil
+
+	return nil
+}
+
+// yield suspends the generator running in the current call frame, moving the frame off the
+// stack, and returns val to whoever resumed it.
+func (v *VM) yield(val value.Value) error {
+	frame := v.frame()
+
+	gen := frame.generator
+	if gen == nil {
+		return v.runtimeError("can only yield from a generator")
+	}
+
+	gen.ip = frame.IP
+	gen.slots = append(gen.slots[:0], v.Stack[frame.Base:]...)
+
+	first := len(v.handlers)
+	for first > 0 && v.handlers[first-1].frames == len(v.Frames) {
+		first--
+	}
+
+	for _, h := range v.handlers[first:] {
+		h.stackTop -= frame.Base
+		gen.handlers = append(gen.handlers, h)
+	}
+
+	v.handlers = v.handlers[:first]
+
+	// open upvalues keep pointing at the frame's slots while they're off the stack.
+	var last *object.Upvalue
+	for upvalue := v.openUpvalues; upvalue != nil && upvalue.Slot >= frame.Base; upvalue = upvalue.Next {
+		upvalue.Slot -= frame.Base
+		upvalue.Location = &gen.slots[upvalue.Slot]
+		last = upvalue
+	}
+
+	if last != nil {
+		gen.upvalues = v.openUpvalues
+		v.openUpvalues = last.Next
+		last.Next = nil
+	}
+
+	gen.state = generatorSuspended
+	v.Frames = v.Frames[:len(v.Frames)-1]
+	v.Stack = v.Stack[:frame.Base]
+	v.Push(val)
+
+	return nil
+}
+
+// generatorNext advances a for-in loop over gen, resuming it and running again once it
+// suspends, with the cursor set, to check whether it yielded or finished.
+func (v *VM) generatorNext(gen *generator, cursor *value.Value) (bool, error) {
+	if cursor.IsBool() && cursor.AsBool() {
+		*cursor = value.NewBool(false)
+
+		if gen.state == generatorDone {
+			v.Pop()
+
+			return true, nil
+		}
+
+		return false, nil
+	}
+
+	if gen.state == generatorDone {
+		return true, nil
+	}
+
+	*cursor = value.NewBool(true)
+	v.frame().IP -= forIterSize
+
+	v.Push(value.NewObj(gen))
+
+	return false, v.resumeGenerator(gen, 0)
+}
+
+func generatorDoneMethod(_ *VM, gen *generator, _ []value.Value) (value.Value, error) {
+	return value.NewBool(gen.state == generatorDone), nil
+}
+
+func asGenerator(val value.Value) (*generator, bool) {
+	if !val.IsObj() {
+		return nil, false
+	}
+
+	gen, ok := val.AsObj().(*generator)
+
+	return gen, ok
+}
@@ -0,0 +1,173 @@
+package vm
+
+import (
+	"unicode/utf8"
+
+	"github.com/meanguy/automato/internal/object"
+	"github.com/meanguy/automato/internal/value"
+)
+
+const (
+	// iterMethodName and nextMethodName make up the iterator protocol. for-in loops call iter()
+	// on an instance once to get its iterator, if the instance has the method, then call next()
+	// on the iterator for every element until it returns nil.
+	iterMethodName = "iter"
+	nextMethodName = "next"
+
+	// forIterSize is the size of an OpForIter instruction: the opcode, the slot of the loop's
+	// first hidden local and the jump out of the loop.
+	forIterSize = 4
+)
+
+// iterInit checks the iterable of a for-in loop on top of the stack can be iterated over.
+// Instances implementing iter() are replaced with the iterator it returns.
+func (v *VM) iterInit() error {
+	if instance, ok := asInstance(v.Peek(0)); ok {
+		_, isField := instance.Fields[v.iterString]
+		_, isMethod := instance.Class.Methods[v.iterString]
+
+		if isField || isMethod {
+			return v.invoke(v.iterString, 0)
+		}
+
+		return nil
+	}
+
+	if !isIterable(v.Peek(0)) {
+		return v.runtimeError("can't iterate over '%s'", v.Peek(0))
+	}
+
+	return nil
+}
+
+// forIter pushes the next element of the for-in loop whose three hidden locals, the iterable,
+// a cursor and the version of the iterable when the loop started, begin at slot. It reports
+// whether the loop is done instead.
+func (v *VM) forIter(slot int) (bool, error) {
+	base := v.frame().Base + slot
+	iterable, cursor, version := v.Stack[base], &v.Stack[base+1], &v.Stack[base+2]
+
+	if !isIterable(iterable) {
+		return false, v.runtimeError("can't iterate over '%s'", iterable)
+	}
+
+	switch obj := iterable.AsObj().(type) {
+	case *object.List:
+		if cursor.IsNil() {
+			*cursor = value.NewInt(0)
+			*version = value.NewInt(int64(obj.Version))
+		}
+
+		if version.AsInt() != int64(obj.Version) {
+			return false, v.runtimeError("list changed size during iteration")
+		}
+
+		i := cursor.AsInt()
+		if i >= int64(len(obj.Elements)) {
+			return true, nil
+		}
+
+		*cursor = value.NewInt(i + 1)
+		v.Push(obj.Elements[i])
+	case *object.Map:
+		if cursor.IsNil() {
+			*cursor = value.NewInt(0)
+			*version = value.NewInt(int64(obj.Version()))
+		}
+
+		if version.AsInt() != int64(obj.Version()) {
+			return false, v.runtimeError("map changed size during iteration")
+		}
+
+		i := cursor.AsInt()
+		if i >= int64(obj.Len()) {
+			return true, nil
+		}
+
+		*cursor = value.NewInt(i + 1)
+		v.Push(obj.Entries()[i].Key)
+	case *object.String:
+		if cursor.IsNil() {
+			*cursor = value.NewInt(0)
+		}
+
+		i := int(cursor.AsInt())
+		if i >= len(obj.Chars) {
+			return true, nil
+		}
+
+		_, size := utf8.DecodeRuneInString(obj.Chars[i:])
+		*cursor = value.NewInt(int64(i + size))
+		v.Push(value.NewObj(v.internString(obj.Chars[i : i+size])))
+	case *object.Range:
+		if cursor.IsNil() {
+			*cursor = value.NewInt(obj.Start)
+		}
+
+		i := cursor.AsInt()
+		if i >= obj.End {
+			return true, nil
+		}
+
+		*cursor = value.NewInt(i + 1)
+		v.Push(value.NewInt(i))
+	case *object.Instance:
+		return v.iterNext(iterable, cursor)
+	case *generator:
+		return v.generatorNext(obj, cursor)
+	}
+
+	return false, nil
+}
+
+// iterNext advances a for-in loop over an iterator implemented by a script. OpForIter calls
+// next() on the iterator and runs again once it returns, this time with the cursor set, to
+// check the result it left on the stack.
+func (v *VM) iterNext(iterator value.Value, cursor *value.Value) (bool, error) {
+	if cursor.IsBool() && cursor.AsBool() {
+		*cursor = value.NewBool(false)
+
+		if v.Peek(0).IsNil() {
+			v.Pop()
+
+			return true, nil
+		}
+
+		return false, nil
+	}
+
+	*cursor = value.NewBool(true)
+	v.frame().IP -= forIterSize
+
+	v.Push(iterator)
+
+	return false, v.invoke(v.nextString, 0)
+}
+
+// buildRange replaces the bounds on top of the stack with the range between them.
+func (v *VM) buildRange() error {
+	if !v.Peek(0).IsInt() || !v.Peek(1).IsInt() {
+		return v.runtimeError("range bounds must be integers")
+	}
+
+	r := v.newRange(v.Peek(1).AsInt(), v.Peek(0).AsInt())
+
+	v.Pop() // end
+	v.Pop() // start
+	v.Push(value.NewObj(r))
+
+	return nil
+}
+
+func isIterable(val value.Value) bool {
+	if !val.IsObj() {
+		return false
+	}
+
+	switch val.AsObj().(type) {
+	case *object.List, *object.Map, *object.String, *object.Range, *object.Instance, *generator:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,127 @@
+package vm
+
+import (
+	"github.com/meanguy/automato/internal/object"
+	"github.com/meanguy/automato/internal/value"
+)
+
+type (
+	// builtinMethod is a method of one of the VM's built-in object types, implemented in Go.
+	// args aliases the stack, and errors are raised with runtimeError.
+	builtinMethod[T object.Obj] struct {
+		arity int
+		fn    func(v *VM, receiver T, args []value.Value) (value.Value, error)
+	}
+)
+
+//nolint:gochecknoglobals // read-only lookup table
+var listMethods = map[string]builtinMethod[*object.List]{
+	"insert": {arity: 2, fn: listInsert},
+	"len":    {arity: 0, fn: listLen},
+	"pop":    {arity: 0, fn: listPop},
+	"push":   {arity: 1, fn: listPush},
+	"remove": {arity: 1, fn: listRemove},
+}
+
+// invokeBuiltin calls the method called name on receiver, which sits on the stack below its
+// arguments, replacing both with the result.
+func invokeBuiltin[T object.Obj](
+	v *VM,
+	methods map[string]builtinMethod[T],
+	receiver T,
+	name *object.String,
+	argCount int,
+) error {
+	method, ok := methods[name.Chars]
+	if !ok {
+		return v.runtimeError("undefined property '%s'", name.Chars)
+	}
+
+	if argCount != method.arity {
+		return v.runtimeError("expected %d arguments but got %d", method.arity, argCount)
+	}
+
+	result, err := method.fn(v, receiver, v.Stack[len(v.Stack)-argCount:])
+	if err != nil {
+		return err
+	}
+
+	v.Stack = v.Stack[:len(v.Stack)-argCount-1]
+	v.Push(result)
+
+	return nil
+}
+
+// listIndex resolves index into a position in list, counting negative indices from the end.
+// When insert is set the position just past the last element is also valid.
+func (v *VM) listIndex(list *object.List, index value.Value, insert bool) (int, error) {
+	if !index.IsInt() {
+		return 0, v.runtimeError("list index must be an integer")
+	}
+
+	position := index.AsInt()
+	if position < 0 {
+		position += int64(len(list.Elements))
+	}
+
+	end := int64(len(list.Elements))
+	if insert {
+		end++
+	}
+
+	if position < 0 || position >= end {
+		return 0, v.runtimeError("list index %d out of range", index.AsInt())
+	}
+
+	return int(position), nil
+}
+
+func listInsert(v *VM, list *object.List, args []value.Value) (value.Value, error) {
+	position, err := v.listIndex(list, args[0], true)
+	if err != nil {
+		return value.NewNil(), err
+	}
+
+	list.Elements = append(list.Elements, value.NewNil())
+	copy(list.Elements[position+1:], list.Elements[position:])
+	list.Elements[position] = args[1]
+	list.Version++
+
+	return value.NewNil(), nil
+}
+
+func listLen(_ *VM, list *object.List, _ []value.Value) (value.Value, error) {
+	return value.NewInt(int64(len(list.Elements))), nil
+}
+
+func listPop(v *VM, list *object.List, _ []value.Value) (value.Value, error) {
+	if len(list.Elements) == 0 {
+		return value.NewNil(), v.runtimeError("pop from empty list")
+	}
+
+	last := list.Elements[len(list.Elements)-1]
+	list.Elements = list.Elements[:len(list.Elements)-1]
+	list.Version++
+
+	return last, nil
+}
+
+func listPush(_ *VM, list *object.List, args []value.Value) (value.Value, error) {
+	list.Elements = append(list.Elements, args[0])
+	list.Version++
+
+	return value.NewNil(), nil
+}
+
+func listRemove(v *VM, list *object.List, args []value.Value) (value.Value, error) {
+	position, err := v.listIndex(list, args[0], false)
+	if err != nil {
+		return value.NewNil(), err
+	}
+
+	removed := list.Elements[position]
+	list.Elements = append(list.Elements[:position], list.Elements[position+1:]...)
+	list.Version++
+
+	return removed, nil
+}
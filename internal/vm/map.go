@@ -0,0 +1,64 @@
+package vm
+
+import (
+	"github.com/meanguy/automato/internal/object"
+	"github.com/meanguy/automato/internal/value"
+)
+
+//nolint:gochecknoglobals // read-only lookup table
+var mapMethods = map[string]builtinMethod[*object.Map]{
+	"delete": {arity: 1, fn: mapDelete},
+	"has":    {arity: 1, fn: mapHas},
+	"keys":   {arity: 0, fn: mapKeys},
+	"len":    {arity: 0, fn: mapLen},
+	"values": {arity: 0, fn: mapValues},
+}
+
+// checkMapKey raises a runtime error if key can't be used as a map key.
+func (v *VM) checkMapKey(key value.Value) error {
+	if !object.IsHashable(key) {
+		return v.runtimeError("map keys must be strings, numbers, booleans or nil")
+	}
+
+	return nil
+}
+
+func mapDelete(v *VM, m *object.Map, args []value.Value) (value.Value, error) {
+	if err := v.checkMapKey(args[0]); err != nil {
+		return value.NewNil(), err
+	}
+
+	return value.NewBool(m.Delete(args[0])), nil
+}
+
+func mapHas(v *VM, m *object.Map, args []value.Value) (value.Value, error) {
+	if err := v.checkMapKey(args[0]); err != nil {
+		return value.NewNil(), err
+	}
+
+	_, ok := m.Get(args[0])
+
+	return value.NewBool(ok), nil
+}
+
+func mapKeys(v *VM, m *object.Map, _ []value.Value) (value.Value, error) {
+	keys := make([]value.Value, 0, m.Len())
+	for _, entry := range m.Entries() {
+		keys = append(keys, entry.Key)
+	}
+
+	return value.NewObj(v.newList(keys)), nil
+}
+
+func mapLen(_ *VM, m *object.Map, _ []value.Value) (value.Value, error) {
+	return value.NewInt(int64(m.Len())), nil
+}
+
+func mapValues(v *VM, m *object.Map, _ []value.Value) (value.Value, error) {
+	values := make([]value.Value, 0, m.Len())
+	for _, entry := range m.Entries() {
+		values = append(values, entry.Value)
+	}
+
+	return value.NewObj(v.newList(values)), nil
+}
@@ -0,0 +1,61 @@
+package vm
+
+import (
+	"github.com/meanguy/automato/internal/object"
+	"github.com/meanguy/automato/internal/value"
+)
+
+// matchClass replaces the value and class on top of the stack with whether the value is an
+// instance of the class or one of its subclasses.
+func (v *VM) matchClass() error {
+	class, ok := v.Peek(0).AsObj().(*object.Class)
+	if !ok {
+		return v.runtimeError("class pattern must name a class")
+	}
+
+	v.Pop()
+
+	fits := false
+	if instance, ok := asInstance(v.Pop()); ok {
+		for c := instance.Class; c != nil && !fits; c = c.Superclass {
+			fits = c == class
+		}
+	}
+
+	v.Push(value.NewBool(fits))
+
+	return nil
+}
+
+// matchField replaces the value on top of the stack with whether it's an instance with a field
+// called name.
+func (v *VM) matchField(name *object.String) {
+	fits := false
+	if instance, ok := asInstance(v.Pop()); ok {
+		_, fits = instance.Fields[name]
+	}
+
+	v.Push(value.NewBool(fits))
+}
+
+// matchRange replaces the value and range bounds on top of the stack with whether the value is
+// a number from the start of the range up to, but not including, its end.
+func (v *VM) matchRange() {
+	end := v.Pop()
+	start := v.Pop()
+	val := v.Pop()
+
+	if !val.IsNumeric() {
+		v.Push(value.NewBool(false))
+
+		return
+	}
+
+	if val.IsInt() && start.IsInt() && end.IsInt() {
+		v.Push(value.NewBool(start.AsInt() <= val.AsInt() && val.AsInt() < end.AsInt()))
+
+		return
+	}
+
+	v.Push(value.NewBool(start.AsFloat() <= val.AsFloat() && val.AsFloat() < end.AsFloat()))
+}
@@ -0,0 +1,163 @@
+package vm
+
+import (
+	"io/fs"
+	"path"
+
+	"github.com/meanguy/automato/internal/object"
+	"github.com/meanguy/automato/internal/scanner"
+	"github.com/meanguy/automato/internal/value"
+)
+
+// WithFS makes the VM load scripts and imported modules from fsys. Without a file system
+// imports are a runtime error.
+func WithFS(fsys fs.FS) VMOption {
+	return func(v *VM) {
+		v.fs = fsys
+	}
+}
+
+// WithSearchPath adds directories of the VM's file system to look for imported modules in
+// when they aren't found relative to the importing script.
+func WithSearchPath(dirs ...string) VMOption {
+	return func(v *VM) {
+		v.searchPath = append(v.searchPath, dirs...)
+	}
+}
+
+// InterpretFile runs the script at name in the VM's file system. The script shares its globals
+// with Interpret, and imports relative to it resolve against its directory.
+func (v *VM) InterpretFile(name string) error {
+	if v.fs == nil {
+		return ErrNoFileSystem
+	}
+
+	source, err := fs.ReadFile(v.fs, name)
+	if err != nil {
+		return err
+	}
+
+	v.main.Path = path.Clean(name)
+	v.modules[v.main.Path] = v.main
+
+	function, err := v.compile(string(source), v.main)
+	if err != nil {
+		return err
+	}
+
+	return v.interpretFunction(function)
+}
+
+// compile compiles source into a script function whose globals live in module.
+func (v *VM) compile(source string, module *object.Module) (*object.Function, error) {
+	v.parser = newParser(v, scanner.NewScanner(source), module)
+	function, err := v.parser.compile()
+	v.parser = nil
+
+	return function, err
+}
+
+// importModule pushes the module at name. A module is run the first time it's imported, in a
+// new call frame whose script returns the module once it's done.
+func (v *VM) importModule(name string) error {
+	resolved, err := v.resolveImport(name)
+	if err != nil {
+		return err
+	}
+
+	if module, ok := v.modules[resolved]; ok {
+		if v.isLoading(module) {
+			return v.runtimeError("import cycle through '%s'", resolved)
+		}
+
+		v.Push(value.NewObj(module))
+
+		return nil
+	}
+
+	source, err := fs.ReadFile(v.fs, resolved)
+	if err != nil {
+		return v.runtimeError("can't read module '%s': %s", resolved, err)
+	}
+
+	module := v.newModule(resolved)
+	v.modules[resolved] = module
+
+	function, err := v.compile(string(source), module)
+	if err != nil {
+		delete(v.modules, resolved)
+
+		return v.runtimeError("can't compile module '%s': %s", resolved, err)
+	}
+
+	v.Push(value.NewObj(function))
+	closure := v.newClosure(function)
+	v.Pop()
+
+	v.Push(value.NewObj(closure))
+
+	return v.call(closure, 0)
+}
+
+// resolveImport returns the canonical path of the module name, looking in the directory of the
+// importing script first and then along the search path.
+func (v *VM) resolveImport(name string) (string, error) {
+	if v.fs == nil {
+		return "", v.runtimeError("can't import '%s': %s", name, ErrNoFileSystem)
+	}
+
+	dirs := append([]string{path.Dir(v.frame().Closure.Function.Module.Path)}, v.searchPath...)
+	for _, dir := range dirs {
+		candidate := path.Join(dir, name)
+		if !fs.ValidPath(candidate) {
+			continue
+		}
+
+		if info, err := fs.Stat(v.fs, candidate); err == nil && !info.IsDir() {
+			return candidate, nil
+		}
+	}
+
+	return "", v.runtimeError("can't find module '%s'", name)
+}
+
+// isLoading reports whether the script of module is still running.
+func (v *VM) isLoading(module *object.Module) bool {
+	for i := range v.Frames {
+		if function := v.Frames[i].Closure.Function; function.Name == nil && function.Module == module {
+			return true
+		}
+	}
+
+	return false
+}
+
+// globals returns the globals of the script the current call frame was compiled from.
+func (v *VM) globals() map[*object.String]value.Value {
+	return v.frame().Closure.Function.Module.Globals
+}
+
+// getGlobal looks name up in the current module, falling back to the built-in globals every
+// module shares.
+func (v *VM) getGlobal(name *object.String) (value.Value, bool) {
+	if val, ok := v.globals()[name]; ok {
+		return val, true
+	}
+
+	val, ok := v.builtins.Globals[name]
+
+	return val, ok
+}
+
+// getExport replaces the module on top of the stack with its export name.
+func (v *VM) getExport(module *object.Module, name *object.String) error {
+	val, ok := module.Export(name)
+	if !ok {
+		return v.runtimeError("module '%s' doesn't export '%s'", module.Path, name.Chars)
+	}
+
+	v.Pop() // module
+	v.Push(val)
+
+	return nil
+}
@@ -3,7 +3,7 @@ package vm
 import "github.com/meanguy/automato/internal/scanner/token"
 
 type (
-	parseFn func(*parser)
+	parseFn func(p *parser, canAssign bool)
 
 	parseRule struct {
 		prefix     parseFn
@@ -21,64 +21,183 @@ var parseRulesTable map[token.TokenType]parseRule
 func init() {
 	parseRulesTable = map[token.TokenType]parseRule{
 		token.LeftParen: {
-			prefix:     func(p *parser) { p.grouping() },
-			precedence: noPrecedence,
+			prefix:     func(p *parser, _ bool) { p.parenthesized() },
+			infix:      func(p *parser, _ bool) { p.call() },
+			precedence: callPrecedence,
 		},
 		token.RightParen: {precedence: noPrecedence},
-		token.LeftBrace:  {precedence: noPrecedence},
+		token.LeftBrace: {
+			prefix:     func(p *parser, _ bool) { p.mapLiteral() },
+			precedence: noPrecedence,
+		},
 		token.RightBrace: {precedence: noPrecedence},
-		token.Comma:      {precedence: noPrecedence},
-		token.Dot:        {precedence: noPrecedence},
+		token.LeftBracket: {
+			prefix:     func(p *parser, _ bool) { p.list() },
+			infix:      func(p *parser, canAssign bool) { p.index(canAssign) },
+			precedence: callPrecedence,
+		},
+		token.RightBracket: {precedence: noPrecedence},
+		token.Colon:        {precedence: noPrecedence},
+		token.Comma:        {precedence: noPrecedence},
+		token.Dot: {
+			infix:      func(p *parser, canAssign bool) { p.dot(canAssign) },
+			precedence: callPrecedence,
+		},
 		token.Minus: {
-			prefix:     func(p *parser) { p.unary() },
-			infix:      func(p *parser) { p.binary() },
+			prefix:     func(p *parser, _ bool) { p.unary() },
+			infix:      func(p *parser, _ bool) { p.binary() },
 			precedence: termPrecedence,
 		},
 		token.Plus: {
-			infix:      func(p *parser) { p.binary() },
+			infix:      func(p *parser, _ bool) { p.binary() },
 			precedence: termPrecedence,
 		},
 		token.Semicolon: {precedence: noPrecedence},
 		token.Slash: {
-			infix:      func(p *parser) { p.binary() },
+			infix:      func(p *parser, _ bool) { p.binary() },
 			precedence: farctorPrecedence,
 		},
 		token.Star: {
-			infix:      func(p *parser) { p.binary() },
+			infix:      func(p *parser, _ bool) { p.binary() },
+			precedence: farctorPrecedence,
+		},
+		token.Percent: {
+			infix:      func(p *parser, _ bool) { p.binary() },
 			precedence: farctorPrecedence,
 		},
-		token.Bang:         {precedence: noPrecedence},
-		token.BangEqual:    {precedence: noPrecedence},
-		token.Equal:        {precedence: noPrecedence},
-		token.EqualEqual:   {precedence: noPrecedence},
-		token.Greater:      {precedence: noPrecedence},
-		token.GreaterEqual: {precedence: noPrecedence},
-		token.Less:         {precedence: noPrecedence},
-		token.LessEqual:    {precedence: noPrecedence},
-		token.Identifier:   {precedence: noPrecedence},
-		token.String:       {precedence: noPrecedence},
+		token.Ampersand: {
+			infix:      func(p *parser, _ bool) { p.binary() },
+			precedence: bitwiseAndPrecedence,
+		},
+		token.Pipe: {
+			infix:      func(p *parser, _ bool) { p.binary() },
+			precedence: bitwiseOrPrecedence,
+		},
+		token.Caret: {
+			infix:      func(p *parser, _ bool) { p.binary() },
+			precedence: bitwiseXorPrecedence,
+		},
+		token.Tilde: {
+			prefix:     func(p *parser, _ bool) { p.unary() },
+			precedence: noPrecedence,
+		},
+		token.Bang: {
+			prefix:     func(p *parser, _ bool) { p.unary() },
+			precedence: noPrecedence,
+		},
+		token.BangEqual: {
+			infix:      func(p *parser, _ bool) { p.binary() },
+			precedence: equalityPrecedence,
+		},
+		token.Equal: {precedence: noPrecedence},
+		token.EqualEqual: {
+			infix:      func(p *parser, _ bool) { p.binary() },
+			precedence: equalityPrecedence,
+		},
+		token.Greater: {
+			infix:      func(p *parser, _ bool) { p.binary() },
+			precedence: comparisonPrecedence,
+		},
+		token.GreaterEqual: {
+			infix:      func(p *parser, _ bool) { p.binary() },
+			precedence: comparisonPrecedence,
+		},
+		token.Less: {
+			infix:      func(p *parser, _ bool) { p.binary() },
+			precedence: comparisonPrecedence,
+		},
+		token.LessEqual: {
+			infix:      func(p *parser, _ bool) { p.binary() },
+			precedence: comparisonPrecedence,
+		},
+		token.LessLess: {
+			infix:      func(p *parser, _ bool) { p.binary() },
+			precedence: shiftPrecedence,
+		},
+		token.GreaterGreater: {
+			infix:      func(p *parser, _ bool) { p.binary() },
+			precedence: shiftPrecedence,
+		},
+		token.DotDot: {
+			infix:      func(p *parser, _ bool) { p.binary() },
+			precedence: rangePrecedence,
+		},
+		token.EqualGreater: {precedence: noPrecedence},
+		token.Identifier: {
+			prefix:     func(p *parser, canAssign bool) { p.variable(canAssign) },
+			precedence: noPrecedence,
+		},
+		token.String: {
+			prefix:     func(p *parser, _ bool) { p.string() },
+			precedence: noPrecedence,
+		},
+		token.Interpolation: {
+			prefix:     func(p *parser, _ bool) { p.interpolation() },
+			precedence: noPrecedence,
+		},
 		token.Number: {
-			prefix:     func(p *parser) { p.number() },
+			prefix:     func(p *parser, _ bool) { p.number() },
+			precedence: noPrecedence,
+		},
+		token.And: {
+			infix:      func(p *parser, _ bool) { p.and() },
+			precedence: andPrecedence,
+		},
+		token.As:    {precedence: noPrecedence},
+		token.Catch: {precedence: noPrecedence},
+		token.Class: {precedence: noPrecedence},
+		token.Else:  {precedence: noPrecedence},
+		token.False: {
+			prefix:     func(p *parser, _ bool) { p.literal() },
+			precedence: noPrecedence,
+		},
+		token.Finally: {precedence: noPrecedence},
+		token.For:     {precedence: noPrecedence},
+		token.Fun: {
+			prefix:     func(p *parser, _ bool) { p.lambda() },
 			precedence: noPrecedence,
 		},
-		token.And:    {precedence: noPrecedence},
-		token.Class:  {precedence: noPrecedence},
-		token.Else:   {precedence: noPrecedence},
-		token.False:  {precedence: noPrecedence},
-		token.For:    {precedence: noPrecedence},
-		token.Fun:    {precedence: noPrecedence},
 		token.If:     {precedence: noPrecedence},
-		token.Nil:    {precedence: noPrecedence},
-		token.Or:     {precedence: noPrecedence},
+		token.Import: {precedence: noPrecedence},
+		token.In:     {precedence: noPrecedence},
+		token.Match: {
+			prefix:     func(p *parser, _ bool) { p.matchExpression() },
+			precedence: noPrecedence,
+		},
+		token.Nil: {
+			prefix:     func(p *parser, _ bool) { p.literal() },
+			precedence: noPrecedence,
+		},
+		token.Or: {
+			infix:      func(p *parser, _ bool) { p.or() },
+			precedence: orPrecedence,
+		},
 		token.Print:  {precedence: noPrecedence},
 		token.Return: {precedence: noPrecedence},
-		token.Super:  {precedence: noPrecedence},
-		token.This:   {precedence: noPrecedence},
-		token.True:   {precedence: noPrecedence},
-		token.Var:    {precedence: noPrecedence},
-		token.While:  {precedence: noPrecedence},
-		token.Error:  {precedence: noPrecedence},
-		token.EOF:    {precedence: noPrecedence},
+		token.Select: {
+			prefix:     func(p *parser, _ bool) { p.selectChannels() },
+			precedence: noPrecedence,
+		},
+		token.Spawn: {precedence: noPrecedence},
+		token.Super: {
+			prefix:     func(p *parser, _ bool) { p.super() },
+			precedence: noPrecedence,
+		},
+		token.This: {
+			prefix:     func(p *parser, _ bool) { p.this() },
+			precedence: noPrecedence,
+		},
+		token.Throw: {precedence: noPrecedence},
+		token.True: {
+			prefix:     func(p *parser, _ bool) { p.literal() },
+			precedence: noPrecedence,
+		},
+		token.Try:   {precedence: noPrecedence},
+		token.Var:   {precedence: noPrecedence},
+		token.While: {precedence: noPrecedence},
+		token.Yield: {precedence: noPrecedence},
+		token.Error: {precedence: noPrecedence},
+		token.EOF:   {precedence: noPrecedence},
 	}
 }
 
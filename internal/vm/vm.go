@@ -1,38 +1,163 @@
 package vm
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"math"
 	"os"
 
 	"github.com/meanguy/automato/internal/debug"
 	"github.com/meanguy/automato/internal/mem"
+	"github.com/meanguy/automato/internal/object"
 	"github.com/meanguy/automato/internal/opcode"
-	"github.com/meanguy/automato/internal/scanner"
 	"github.com/meanguy/automato/internal/value"
 )
 
 type (
 	VM struct {
-		Debug bool
-		IP    int
-		Chunk *mem.Chunk
-		Stack []value.Value
+		Debug  bool
+		Frames []CallFrame
+		Stack  []value.Value
+		Stdout io.Writer
+
+		strings    map[string]*object.String
+		initString *object.String
+
+		// iterString and nextString name the methods of the iterator protocol.
+		iterString *object.String
+		nextString *object.String
+
+		// builtins holds the natives and prelude classes visible from every module, and main is
+		// the module of scripts run by Interpret and InterpretFile. Imported modules are cached
+		// in modules by their canonical path.
+		builtins *object.Module
+		main     *object.Module
+		modules  map[string]*object.Module
+
+		// fs is the file system scripts are loaded from, searching searchPath for imports.
+		fs         fs.FS
+		searchPath []string
+
+		// messageString and traceString name the fields of errors, and errorClass is the class
+		// of the errors the VM raises.
+		messageString *object.String
+		traceString   *object.String
+		errorClass    *object.Class
+
+		// fiber is the fiber running, whose stack, call frames, handlers and open upvalues are
+		// the VM's own. mainFiber runs the scripts passed to Interpret, fibers holds every
+		// spawned fiber that hasn't finished yet, and ready queues the fibers waiting to run.
+		fiber     *fiber
+		mainFiber *fiber
+		fibers    []*fiber
+		ready     []*fiber
+
+		// handlers is the stack of active catch and finally clauses, innermost last.
+		handlers []handler
+
+		// openUpvalues lists the upvalues still pointing into the stack, ordered by descending
+		// stack slot.
+		openUpvalues *object.Upvalue
+
+		// parser is the parser compiling source for the VM, if any. The functions it's compiling
+		// are garbage collection roots.
+		parser *parser
+
+		objects        []object.Obj
+		grayStack      []object.Obj
+		bytesAllocated int
+		nextGC         int
+		stressGC       bool
+	}
+
+	// CallFrame is an ongoing function call. Base is the index in the VM's stack of the frame's
+	// first slot, which holds the closure being called.
+	CallFrame struct {
+		Closure *object.Closure
+		IP      int
+		Base    int
+
+		// generator is the generator the frame is running, if any.
+		generator *generator
 	}
 
 	VMOption func(*VM)
 )
 
+const (
+	FramesMax = 64
+	StackMax  = FramesMax * (math.MaxUint8 + 1)
+
+	// maxShift is the exclusive upper bound on shift counts; integers are 64 bits wide.
+	maxShift = 64
+
+	// Variadic is the arity of a native function accepting any number of arguments.
+	Variadic = -1
+)
+
 func NewVM(opts ...VMOption) *VM {
 	vm := &VM{
-		Debug: false,
-		Chunk: nil,
-		IP:    0,
+		Debug:   false,
+		Frames:  make([]CallFrame, 0, FramesMax),
+		Stack:   make([]value.Value, 0, StackMax),
+		Stdout:  os.Stdout,
+		strings: map[string]*object.String{},
+
+		builtins:   nil,
+		main:       nil,
+		modules:    map[string]*object.Module{},
+		fs:         nil,
+		searchPath: nil,
+
+		messageString: nil,
+		traceString:   nil,
+		errorClass:    nil,
+		handlers:      nil,
+
+		fiber:     nil,
+		mainFiber: nil,
+		fibers:    nil,
+		ready:     nil,
+
+		openUpvalues: nil,
+		parser:       nil,
+
+		objects:        nil,
+		grayStack:      nil,
+		bytesAllocated: 0,
+		nextGC:         initialGCThreshold,
+		stressGC:       false,
 	}
 
+	vm.mainFiber = &fiber{
+		stack:        nil,
+		frames:       nil,
+		handlers:     nil,
+		openUpvalues: nil,
+		state:        fiberDone,
+		method:       nil,
+		argCount:     -1,
+		generator:    nil,
+		wait:         0,
+		err:          "",
+	}
+	vm.fiber = vm.mainFiber
+
+	vm.builtins = vm.newModule("")
+	vm.main = vm.newModule("")
+	vm.defineNative(channelNativeName, Variadic, vm.makeChannel)
+
 	for _, fn := range opts {
 		fn(vm)
 	}
 
+	vm.initString = vm.internString(initializerName)
+	vm.iterString = vm.internString(iterMethodName)
+	vm.nextString = vm.internString(nextMethodName)
+	vm.loadPrelude()
+
 	return vm
 }
 
@@ -42,83 +167,1012 @@ func EnableDebug() VMOption {
 	}
 }
 
+// WithStdout redirects the output of print statements to w.
+func WithStdout(w io.Writer) VMOption {
+	return func(v *VM) {
+		v.Stdout = w
+	}
+}
+
+// WithNative installs fn as a global function called name. Calling it with a number of
+// arguments other than arity is a runtime error, unless arity is Variadic. An error returned
+// by fn is reported as a runtime error on the line of the call.
+func WithNative(name string, arity int, fn object.NativeFn) VMOption {
+	return func(v *VM) {
+		v.defineNative(name, arity, fn)
+	}
+}
+
 func (v *VM) Interpret(source string) error {
-	parser := newParser(scanner.NewScanner(source), v.Debug)
-	chunk, err := parser.compile()
+	function, err := v.compile(source, v.main)
 	if err != nil {
 		return err
 	}
 
-	return v.InterpretChunk(chunk)
+	return v.interpretFunction(function)
 }
 
+// InterpretChunk runs chunk as the body of a top-level script.
 func (v *VM) InterpretChunk(chunk *mem.Chunk) error {
-	v.Chunk = chunk
-	v.IP = 0
+	function := v.newFunction()
+	function.Chunk = *chunk
+	function.Module = v.main
+
+	return v.interpretFunction(function)
+}
+
+func (v *VM) interpretFunction(function *object.Function) error {
+	v.Push(value.NewObj(function))
+	closure := v.newClosure(function)
+	v.Pop()
+
+	v.Push(value.NewObj(closure))
+	if err := v.call(closure, 0); err != nil {
+		v.resetStack()
+
+		return err
+	}
 
 	return v.run()
 }
 
+// Push pushes val on top of the stack, growing it if it's full. Pushing onto a stack of
+// StackMax values panics with ErrStackOverflow, which the VM reports as a RuntimeError while
+// running.
 func (v *VM) Push(val value.Value) {
+	if len(v.Stack) == cap(v.Stack) {
+		v.growStack()
+	}
+
 	v.Stack = append(v.Stack, val)
 }
 
+// growStack moves the stack to a backing array twice its size, pointing the open upvalues at
+// their slots in the new array.
+func (v *VM) growStack() {
+	if cap(v.Stack) >= StackMax {
+		panic(ErrStackOverflow)
+	}
+
+	size := 2 * cap(v.Stack)
+	if size == 0 {
+		size = fiberStack
+	} else if size > StackMax {
+		size = StackMax
+	}
+
+	stack := make([]value.Value, len(v.Stack), size)
+	copy(stack, v.Stack)
+	v.Stack = stack
+
+	for upvalue := v.openUpvalues; upvalue != nil; upvalue = upvalue.Next {
+		upvalue.Location = &v.Stack[upvalue.Slot]
+	}
+}
+
+// Pop removes and returns the value on top of the stack. Popping an empty stack panics with
+// ErrStackUnderflow, which the VM reports as a RuntimeError while running.
 func (v *VM) Pop() value.Value {
+	if len(v.Stack) == 0 {
+		panic(ErrStackUnderflow)
+	}
+
 	val := v.Stack[len(v.Stack)-1]
 	v.Stack = v.Stack[:len(v.Stack)-1]
 
 	return val
 }
 
-//nolint:cyclop // interpreting opcodes is necessarily complex
+// Peek returns the value distance slots down from the top of the stack without removing it.
+func (v *VM) Peek(distance int) value.Value {
+	if distance >= len(v.Stack) {
+		panic(ErrStackUnderflow)
+	}
+
+	return v.Stack[len(v.Stack)-1-distance]
+}
+
+func (v *VM) resetStack() {
+	v.resetFibers()
+	v.discardFrames(0)
+	v.closeUpvalues(0)
+	v.Stack = v.Stack[:0]
+	v.handlers = v.handlers[:0]
+}
+
+func (v *VM) frame() *CallFrame {
+	return &v.Frames[len(v.Frames)-1]
+}
+
+// run executes instructions until the script and every fiber it spawned have finished,
+// switching to the next fiber whenever the running one suspends. Runtime errors go to the
+// innermost exception handler of the fiber raising them, and stop the VM if there isn't one.
 func (v *VM) run() error {
+	v.mainFiber.state = fiberRunning
+
 	for {
+		err := v.step()
+
+		var rtErr *RuntimeError
+
+		switch {
+		case err == nil:
+			v.finishFiber()
+		case errors.Is(err, errSuspended):
+		case errors.As(err, &rtErr) && v.catch(rtErr):
+			continue
+		default:
+			v.resetStack()
+
+			return err
+		}
+
+		if done, err := v.schedule(); done {
+			return err
+		}
+	}
+}
+
+//nolint:cyclop // interpreting opcodes is necessarily complex
+func (v *VM) execute() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			//nolint:errorlint // sentinel panic values, never wrapped
+			switch r {
+			case ErrStackUnderflow:
+				err = v.runtimeError("stack underflow")
+			case ErrStackOverflow:
+				err = v.runtimeError("stack overflow")
+			default:
+				panic(r)
+			}
+		}
+	}()
+
+	for {
+		if frame := v.frame(); frame.IP >= len(frame.Closure.Function.Chunk.Code) {
+			return v.runtimeError("unexpected end of chunk")
+		}
+
 		instruction := opcode.OpCode(v.readByte())
 
 		if v.Debug {
+			frame := v.frame()
 			debug.DisassembleStack(os.Stderr, v.Stack)
-			debug.DisassembleInstruction(os.Stderr, v.Chunk, v.IP-1)
+			debug.DisassembleInstruction(os.Stderr, &frame.Closure.Function.Chunk, frame.IP-1)
 		}
 
 		switch instruction {
 		case opcode.OpReturn:
-			fmt.Fprintf(os.Stderr, "%v\n", v.Pop())
+			if v.returnFrom(v.Pop()) {
+				return nil
+			}
+		case opcode.OpCall:
+			argCount := int(v.readByte())
+			err = v.callValue(v.Peek(argCount), argCount)
+		case opcode.OpClosure:
+			function, _ := v.readConstant(int(v.readWord())).AsObj().(*object.Function)
+			closure := v.newClosure(function)
+			v.Push(value.NewObj(closure))
 
-			return nil
+			for i := range closure.Upvalues {
+				isLocal := v.readByte() == 1
+				index := int(v.readByte())
+
+				if isLocal {
+					closure.Upvalues[i] = v.captureUpvalue(v.frame().Base + index)
+				} else {
+					closure.Upvalues[i] = v.frame().Closure.Upvalues[index]
+				}
+			}
+		case opcode.OpGetUpvalue:
+			slot := int(v.readByte())
+			v.Push(*v.frame().Closure.Upvalues[slot].Location)
+		case opcode.OpSetUpvalue:
+			slot := int(v.readByte())
+			*v.frame().Closure.Upvalues[slot].Location = v.Peek(0)
+		case opcode.OpCloseUpvalue:
+			v.closeUpvalues(len(v.Stack) - 1)
+			v.Pop()
+		case opcode.OpClass:
+			v.Push(value.NewObj(v.newClass(v.readString())))
+		case opcode.OpMethod:
+			v.defineMethod(v.readString())
+		case opcode.OpGetProperty:
+			err = v.getProperty(v.readString())
+		case opcode.OpSetProperty:
+			err = v.setProperty(v.readString())
+		case opcode.OpInvoke:
+			name := v.readString()
+			argCount := int(v.readByte())
+			err = v.invoke(name, argCount)
+		case opcode.OpInherit:
+			superclass, ok := v.Peek(1).AsObj().(*object.Class)
+			if !ok {
+				return v.runtimeError("superclass must be a class")
+			}
+
+			subclass, _ := v.Peek(0).AsObj().(*object.Class)
+			subclass.Superclass = superclass
+
+			for name, method := range superclass.Methods {
+				subclass.Methods[name] = method
+			}
+
+			v.Pop() // subclass
+		case opcode.OpGetSuper:
+			name := v.readString()
+			superclass, _ := v.Pop().AsObj().(*object.Class)
+			err = v.bindMethod(superclass, name)
+		case opcode.OpSuperInvoke:
+			name := v.readString()
+			argCount := int(v.readByte())
+			superclass, _ := v.Pop().AsObj().(*object.Class)
+			err = v.invokeFromClass(superclass, name, argCount)
 		case opcode.OpConstant:
-			v.Push(v.Chunk.GetConstant(int(v.readByte())))
+			v.Push(v.readConstant(int(v.readByte())))
 		case opcode.OpConstantLong:
-			v.Push(v.Chunk.GetConstant(int(v.readWord())))
+			v.Push(v.readConstant(int(v.readWord())))
+		case opcode.OpPop:
+			v.Pop()
+		case opcode.OpPrint:
+			fmt.Fprintf(v.Stdout, "%v\n", v.Pop())
+		case opcode.OpDefineGlobal:
+			name := v.readString()
+			v.globals()[name] = v.Pop()
+		case opcode.OpGetGlobal:
+			name := v.readString()
+
+			val, ok := v.getGlobal(name)
+			if !ok {
+				return v.runtimeError("undefined variable '%s'", name.Chars)
+			}
+
+			v.Push(val)
+		case opcode.OpSetGlobal:
+			// assigning a built-in shadows it in the current module only.
+			name := v.readString()
+			if _, ok := v.getGlobal(name); !ok {
+				return v.runtimeError("undefined variable '%s'", name.Chars)
+			}
+
+			v.globals()[name] = v.Peek(0)
+		case opcode.OpGetLocal:
+			slot := int(v.readByte())
+			v.Push(v.Stack[v.frame().Base+slot])
+		case opcode.OpSetLocal:
+			slot := int(v.readByte())
+			v.Stack[v.frame().Base+slot] = v.Peek(0)
+		case opcode.OpJump:
+			offset := v.readWord()
+			v.frame().IP += int(offset)
+		case opcode.OpJumpIfFalse:
+			offset := v.readWord()
+			if v.Peek(0).IsFalsey() {
+				v.frame().IP += int(offset)
+			}
+		case opcode.OpLoop:
+			offset := v.readWord()
+			v.frame().IP -= int(offset)
+		case opcode.OpNil:
+			v.Push(value.NewNil())
+		case opcode.OpTrue:
+			v.Push(value.NewBool(true))
+		case opcode.OpFalse:
+			v.Push(value.NewBool(false))
 		case opcode.OpNegate:
-			v.Push(-v.Pop())
+			switch operand := v.Peek(0); {
+			case operand.IsInt():
+				v.Push(value.NewInt(-v.Pop().AsInt()))
+			case operand.IsNumber():
+				v.Push(value.NewNumber(-v.Pop().AsNumber()))
+			default:
+				return v.runtimeError("operand must be a number")
+			}
+		case opcode.OpBitNot:
+			if !v.Peek(0).IsInt() {
+				return v.runtimeError("operand must be an integer")
+			}
+
+			v.Push(value.NewInt(^v.Pop().AsInt()))
+		case opcode.OpNot:
+			v.Push(value.NewBool(v.Pop().IsFalsey()))
+		case opcode.OpEqual:
+			rhs := v.Pop()
+			lhs := v.Pop()
+			v.Push(value.NewBool(value.Equal(lhs, rhs)))
+		case opcode.OpGreater:
+			err = v.binaryOp(
+				func(lhs, rhs int64) value.Value { return value.NewBool(lhs > rhs) },
+				func(lhs, rhs float64) value.Value { return value.NewBool(lhs > rhs) },
+			)
+		case opcode.OpLess:
+			err = v.binaryOp(
+				func(lhs, rhs int64) value.Value { return value.NewBool(lhs < rhs) },
+				func(lhs, rhs float64) value.Value { return value.NewBool(lhs < rhs) },
+			)
 		case opcode.OpAdd:
-			v.binaryOp(func(lhs value.Value, rhs value.Value) value.Value { return lhs + rhs })
+			switch {
+			case isString(v.Peek(0)) && isString(v.Peek(1)):
+				v.concatenate()
+			case v.Peek(0).IsNumeric() && v.Peek(1).IsNumeric():
+				err = v.binaryOp(
+					func(lhs, rhs int64) value.Value { return value.NewInt(lhs + rhs) },
+					func(lhs, rhs float64) value.Value { return value.NewNumber(lhs + rhs) },
+				)
+			default:
+				return v.runtimeError("operands must be two numbers or two strings")
+			}
 		case opcode.OpSubtract:
-			v.binaryOp(func(lhs value.Value, rhs value.Value) value.Value { return lhs - rhs })
+			err = v.binaryOp(
+				func(lhs, rhs int64) value.Value { return value.NewInt(lhs - rhs) },
+				func(lhs, rhs float64) value.Value { return value.NewNumber(lhs - rhs) },
+			)
 		case opcode.OpMultiply:
-			v.binaryOp(func(lhs value.Value, rhs value.Value) value.Value { return lhs * rhs })
+			err = v.binaryOp(
+				func(lhs, rhs int64) value.Value { return value.NewInt(lhs * rhs) },
+				func(lhs, rhs float64) value.Value { return value.NewNumber(lhs * rhs) },
+			)
 		case opcode.OpDivide:
-			v.binaryOp(func(lhs value.Value, rhs value.Value) value.Value { return lhs / rhs })
+			if isZero(v.Peek(0)) {
+				return v.runtimeError("division by zero")
+			}
+
+			err = v.binaryOp(
+				func(lhs, rhs int64) value.Value { return value.NewInt(lhs / rhs) },
+				func(lhs, rhs float64) value.Value { return value.NewNumber(lhs / rhs) },
+			)
+		case opcode.OpModulo:
+			if isZero(v.Peek(0)) {
+				return v.runtimeError("division by zero")
+			}
+
+			err = v.binaryOp(
+				func(lhs, rhs int64) value.Value { return value.NewInt(lhs % rhs) },
+				func(lhs, rhs float64) value.Value { return value.NewNumber(math.Mod(lhs, rhs)) },
+			)
+		case opcode.OpBitAnd:
+			err = v.integerOp(func(lhs, rhs int64) int64 { return lhs & rhs })
+		case opcode.OpBitOr:
+			err = v.integerOp(func(lhs, rhs int64) int64 { return lhs | rhs })
+		case opcode.OpBitXor:
+			err = v.integerOp(func(lhs, rhs int64) int64 { return lhs ^ rhs })
+		case opcode.OpShiftLeft:
+			if count := v.Peek(0); count.IsInt() && (count.AsInt() < 0 || count.AsInt() >= maxShift) {
+				return v.runtimeError("shift count %d out of range", count.AsInt())
+			}
+
+			err = v.integerOp(func(lhs, rhs int64) int64 { return lhs << rhs })
+		case opcode.OpShiftRight:
+			if count := v.Peek(0); count.IsInt() && (count.AsInt() < 0 || count.AsInt() >= maxShift) {
+				return v.runtimeError("shift count %d out of range", count.AsInt())
+			}
+
+			err = v.integerOp(func(lhs, rhs int64) int64 { return lhs >> rhs })
+		case opcode.OpBuildList:
+			count := int(v.readWord())
+			elements := make([]value.Value, count)
+			copy(elements, v.Stack[len(v.Stack)-count:])
+
+			// the elements stay on the stack while the list is allocated.
+			list := v.newList(elements)
+			v.Stack = v.Stack[:len(v.Stack)-count]
+			v.Push(value.NewObj(list))
+		case opcode.OpBuildMap:
+			err = v.buildMap(int(v.readWord()))
+		case opcode.OpToString:
+			if !isString(v.Peek(0)) {
+				str := v.internString(v.Peek(0).String())
+				v.Pop()
+				v.Push(value.NewObj(str))
+			}
+		case opcode.OpThrow:
+			err = v.throwValue(v.Pop())
+		case opcode.OpPushCatch:
+			v.pushHandler(false)
+		case opcode.OpPushFinally:
+			v.pushHandler(true)
+		case opcode.OpPopHandler:
+			v.handlers = v.handlers[:len(v.handlers)-1]
+		case opcode.OpEndFinally:
+			var done bool
+			if done, err = v.endFinally(); done {
+				return nil
+			}
+		case opcode.OpImport:
+			err = v.importModule(v.readString().Chars)
+		case opcode.OpRange:
+			err = v.buildRange()
+		case opcode.OpIterInit:
+			err = v.iterInit()
+		case opcode.OpForIter:
+			slot := int(v.readByte())
+			offset := int(v.readWord())
+
+			var done bool
+			if done, err = v.forIter(slot); done {
+				v.frame().IP += offset
+			}
+		case opcode.OpYield:
+			// a fiber spawned with a generator function lets the others run when it yields.
+			if err = v.yield(v.Pop()); err == nil && len(v.Frames) == 0 {
+				err = v.yieldFiber()
+			}
+		case opcode.OpSpawn:
+			v.spawn(nil, int(v.readByte()))
+		case opcode.OpSpawnInvoke:
+			name := v.readString()
+			v.spawn(name, int(v.readByte()))
+		case opcode.OpSelect:
+			err = v.selectChannels(int(v.readByte()))
+		case opcode.OpMatchList:
+			count := int(v.readWord())
+			list, ok := asList(v.Pop())
+			v.Push(value.NewBool(ok && len(list.Elements) == count))
+		case opcode.OpMatchMap:
+			v.Push(value.NewBool(isMap(v.Pop())))
+		case opcode.OpMatchClass:
+			err = v.matchClass()
+		case opcode.OpMatchField:
+			v.matchField(v.readString())
+		case opcode.OpMatchRange:
+			v.matchRange()
+		case opcode.OpNoMatch:
+			return v.runtimeError("no match for '%s'", v.Pop())
+		case opcode.OpIndexGet:
+			err = v.indexGet()
+		case opcode.OpIndexSet:
+			err = v.indexSet()
+		default:
+			return v.runtimeError("unknown opcode %d", instruction)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// returnFrom returns result from the current call frame, reporting whether that finished the
+// script. A finally clause in the frame runs first, and returns once it's done.
+func (v *VM) returnFrom(result value.Value) bool {
+	if v.enterFinally(result) {
+		return false
+	}
+
+	frame := v.frame()
+
+	// a generator finishes by returning, and what it returns is discarded.
+	if frame.generator != nil {
+		frame.generator.finish()
+		result = value.NewNil()
+	}
+
+	v.closeUpvalues(frame.Base)
+	v.Frames = v.Frames[:len(v.Frames)-1]
+	v.Stack = v.Stack[:frame.Base]
+
+	if len(v.Frames) == 0 {
+		return true
+	}
+
+	v.Push(result)
+
+	return false
+}
+
+func (v *VM) callValue(callee value.Value, argCount int) error {
+	if callee.IsObj() {
+		switch callee := callee.AsObj().(type) {
+		case *object.BoundMethod:
+			v.Stack[len(v.Stack)-argCount-1] = callee.Receiver
+
+			return v.call(callee.Method, argCount)
+		case *object.Class:
+			v.Stack[len(v.Stack)-argCount-1] = value.NewObj(v.newInstance(callee))
+
+			if initializer, ok := callee.Methods[v.initString]; ok {
+				method, _ := initializer.AsObj().(*object.Closure)
+
+				return v.call(method, argCount)
+			}
+
+			if argCount != 0 {
+				return v.runtimeError("expected 0 arguments but got %d", argCount)
+			}
+
+			return nil
+		case *object.Closure:
+			return v.call(callee, argCount)
+		case *object.Native:
+			return v.callNative(callee, argCount)
+		}
+	}
+
+	return v.runtimeError("can only call functions and classes")
+}
+
+func (v *VM) callNative(native *object.Native, argCount int) error {
+	if !native.IsVariadic() && argCount != native.Arity {
+		return v.runtimeError("expected %d arguments but got %d", native.Arity, argCount)
+	}
+
+	result, err := native.Fn(v.Stack[len(v.Stack)-argCount:])
+	if err != nil {
+		return v.runtimeError("%s", err.Error())
+	}
+
+	// strings built by natives aren't interned yet, and interned strings are compared by
+	// identity.
+	if str, ok := asString(result); ok {
+		result = value.NewObj(v.internString(str.Chars))
+	}
+
+	v.Stack = v.Stack[:len(v.Stack)-argCount-1]
+	v.Push(result)
+
+	return nil
+}
+
+func (v *VM) defineNative(name string, arity int, fn object.NativeFn) {
+	// both objects stay on the stack until they're reachable from the globals.
+	v.Push(value.NewObj(v.internString(name)))
+	v.Push(value.NewObj(v.newNative(name, arity, fn)))
+
+	key, _ := asString(v.Peek(1))
+	v.builtins.Globals[key] = v.Peek(0)
+
+	v.Pop()
+	v.Pop()
+}
+
+func (v *VM) call(closure *object.Closure, argCount int) error {
+	if argCount != closure.Function.Arity {
+		return v.runtimeError("expected %d arguments but got %d", closure.Function.Arity, argCount)
+	}
+
+	if closure.Function.IsGenerator {
+		v.startGenerator(closure, argCount)
+
+		return nil
+	}
+
+	if len(v.Frames) == FramesMax {
+		return v.runtimeError("stack overflow")
+	}
+
+	v.Frames = append(v.Frames, CallFrame{
+		Closure:   closure,
+		IP:        0,
+		Base:      len(v.Stack) - argCount - 1,
+		generator: nil,
+	})
+
+	return nil
+}
+
+// discardFrames drops the call frames from first on without returning from them, as when an
+// exception unwinds them. Modules they were importing are uncached so importing them again
+// starts over, and generators they were running are finished.
+func (v *VM) discardFrames(first int) {
+	for i := first; i < len(v.Frames); i++ {
+		frame := &v.Frames[i]
+
+		if function := frame.Closure.Function; function.Name == nil && function.Module != v.main {
+			delete(v.modules, function.Module.Path)
+		}
+
+		if frame.generator != nil {
+			frame.generator.finish()
+		}
+	}
+
+	v.Frames = v.Frames[:first]
+}
+
+// invoke calls the method name on the receiver below the arguments on the stack without
+// allocating a bound method. Fields shadow methods, so a field holding a function is called
+// instead if there is one.
+func (v *VM) invoke(name *object.String, argCount int) error {
+	switch receiver := v.Peek(argCount); {
+	case isList(receiver):
+		list, _ := asList(receiver)
+
+		return invokeBuiltin(v, listMethods, list, name, argCount)
+	case isMap(receiver):
+		m, _ := asMap(receiver)
+
+		return invokeBuiltin(v, mapMethods, m, name, argCount)
+	case isGenerator(receiver):
+		gen, _ := asGenerator(receiver)
+		if name == v.nextString {
+			return v.resumeGenerator(gen, argCount)
+		}
+
+		return invokeBuiltin(v, generatorMethods, gen, name, argCount)
+	case isChannel(receiver):
+		c, _ := asChannel(receiver)
+
+		return invokeBuiltin(v, channelMethods, c, name, argCount)
+	case isModule(receiver):
+		module, _ := asModule(receiver)
+
+		export, ok := module.Export(name)
+		if !ok {
+			return v.runtimeError("module '%s' doesn't export '%s'", module.Path, name.Chars)
+		}
+
+		v.Stack[len(v.Stack)-argCount-1] = export
+
+		return v.callValue(export, argCount)
+	}
+
+	instance, ok := asInstance(v.Peek(argCount))
+	if !ok {
+		return v.runtimeError("only instances have methods")
+	}
+
+	if field, ok := instance.Fields[name]; ok {
+		v.Stack[len(v.Stack)-argCount-1] = field
+
+		return v.callValue(field, argCount)
+	}
+
+	return v.invokeFromClass(instance.Class, name, argCount)
+}
+
+func (v *VM) invokeFromClass(class *object.Class, name *object.String, argCount int) error {
+	method, ok := class.Methods[name]
+	if !ok {
+		return v.runtimeError("undefined property '%s'", name.Chars)
+	}
+
+	closure, _ := method.AsObj().(*object.Closure)
+
+	return v.call(closure, argCount)
+}
+
+func (v *VM) getProperty(name *object.String) error {
+	if module, ok := asModule(v.Peek(0)); ok {
+		return v.getExport(module, name)
+	}
+
+	instance, ok := asInstance(v.Peek(0))
+	if !ok {
+		return v.runtimeError("only instances have properties")
+	}
+
+	if field, ok := instance.Fields[name]; ok {
+		v.Pop() // instance
+		v.Push(field)
+
+		return nil
+	}
+
+	return v.bindMethod(instance.Class, name)
+}
+
+// buildMap replaces the count key/value pairs on top of the stack with a map holding them.
+func (v *VM) buildMap(count int) error {
+	// the entries stay on the stack until they're reachable from the map.
+	v.Push(value.NewObj(v.newMap()))
+	m, _ := asMap(v.Peek(0))
+
+	entries := v.Stack[len(v.Stack)-2*count-1 : len(v.Stack)-1]
+	for i := 0; i < len(entries); i += 2 {
+		if err := v.checkMapKey(entries[i]); err != nil {
+			return err
+		}
+
+		m.Set(entries[i], entries[i+1])
+	}
+
+	v.Stack = v.Stack[:len(v.Stack)-2*count-1]
+	v.Push(value.NewObj(m))
+
+	return nil
+}
+
+func (v *VM) indexGet() error {
+	if m, ok := asMap(v.Peek(1)); ok {
+		if err := v.checkMapKey(v.Peek(0)); err != nil {
+			return err
 		}
+
+		val, ok := m.Get(v.Peek(0))
+		if !ok {
+			return v.runtimeError("undefined key '%s'", v.Peek(0))
+		}
+
+		v.Pop() // key
+		v.Pop() // map
+		v.Push(val)
+
+		return nil
+	}
+
+	list, ok := asList(v.Peek(1))
+	if !ok {
+		return v.runtimeError("only lists and maps can be indexed")
+	}
+
+	position, err := v.listIndex(list, v.Peek(0), false)
+	if err != nil {
+		return err
+	}
+
+	v.Pop() // index
+	v.Pop() // container
+	v.Push(list.Elements[position])
+
+	return nil
+}
+
+func (v *VM) indexSet() error {
+	switch container := v.Peek(2); {
+	case isMap(container):
+		m, _ := asMap(container)
+		if err := v.checkMapKey(v.Peek(1)); err != nil {
+			return err
+		}
+
+		m.Set(v.Peek(1), v.Peek(0))
+	case isList(container):
+		list, _ := asList(container)
+
+		position, err := v.listIndex(list, v.Peek(1), false)
+		if err != nil {
+			return err
+		}
+
+		list.Elements[position] = v.Peek(0)
+	default:
+		return v.runtimeError("only lists and maps can be indexed")
+	}
+
+	val := v.Pop()
+	v.Pop() // index
+	v.Pop() // container
+	v.Push(val)
+
+	return nil
+}
+
+func (v *VM) setProperty(name *object.String) error {
+	instance, ok := asInstance(v.Peek(1))
+	if !ok {
+		return v.runtimeError("only instances have fields")
+	}
+
+	instance.Fields[name] = v.Peek(0)
+
+	val := v.Pop()
+	v.Pop() // instance
+	v.Push(val)
+
+	return nil
+}
+
+// bindMethod replaces the instance on top of the stack with its class's method name bound to
+// the instance.
+func (v *VM) bindMethod(class *object.Class, name *object.String) error {
+	method, ok := class.Methods[name]
+	if !ok {
+		return v.runtimeError("undefined property '%s'", name.Chars)
+	}
+
+	closure, _ := method.AsObj().(*object.Closure)
+	bound := v.newBoundMethod(v.Peek(0), closure)
+
+	v.Pop() // instance
+	v.Push(value.NewObj(bound))
+
+	return nil
+}
+
+func (v *VM) defineMethod(name *object.String) {
+	method := v.Peek(0)
+	class, _ := v.Peek(1).AsObj().(*object.Class)
+	class.Methods[name] = method
+
+	v.Pop()
+}
+
+// captureUpvalue returns the open upvalue for the stack slot, creating it if no closure has
+// captured the slot yet so closures capturing the same variable share it.
+func (v *VM) captureUpvalue(slot int) *object.Upvalue {
+	var prev *object.Upvalue
+
+	upvalue := v.openUpvalues
+	for upvalue != nil && upvalue.Slot > slot {
+		prev = upvalue
+		upvalue = upvalue.Next
+	}
+
+	if upvalue != nil && upvalue.Slot == slot {
+		return upvalue
+	}
+
+	created := v.newUpvalue(slot)
+	created.Next = upvalue
+
+	if prev == nil {
+		v.openUpvalues = created
+	} else {
+		prev.Next = created
+	}
+
+	return created
+}
+
+// closeUpvalues closes every open upvalue pointing at the stack slot last or above it.
+func (v *VM) closeUpvalues(last int) {
+	for v.openUpvalues != nil && v.openUpvalues.Slot >= last {
+		upvalue := v.openUpvalues
+		upvalue.Close()
+		v.openUpvalues = upvalue.Next
 	}
 }
 
-func (v *VM) binaryOp(fn func(value.Value, value.Value) value.Value) {
+// binaryOp applies intFn when both operands are integers and floatFn otherwise, promoting an
+// integer operand to a float when the operands are mixed.
+func (v *VM) binaryOp(intFn func(int64, int64) value.Value, floatFn func(float64, float64) value.Value) error {
+	if !v.Peek(0).IsNumeric() || !v.Peek(1).IsNumeric() {
+		return v.runtimeError("operands must be numbers")
+	}
+
 	rhs := v.Pop()
 	lhs := v.Pop()
-	v.Push(fn(lhs, rhs))
+
+	if lhs.IsInt() && rhs.IsInt() {
+		v.Push(intFn(lhs.AsInt(), rhs.AsInt()))
+	} else {
+		v.Push(floatFn(lhs.AsFloat(), rhs.AsFloat()))
+	}
+
+	return nil
+}
+
+// integerOp applies fn to two integer operands; bitwise operators are not defined for floats.
+func (v *VM) integerOp(fn func(int64, int64) int64) error {
+	if !v.Peek(0).IsInt() || !v.Peek(1).IsInt() {
+		return v.runtimeError("operands must be integers")
+	}
+
+	rhs := v.Pop().AsInt()
+	lhs := v.Pop().AsInt()
+	v.Push(value.NewInt(fn(lhs, rhs)))
+
+	return nil
+}
+
+func isZero(val value.Value) bool {
+	return val.IsNumeric() && val.AsFloat() == 0
+}
+
+func (v *VM) concatenate() {
+	rhs, _ := asString(v.Pop())
+	lhs, _ := asString(v.Pop())
+
+	v.Push(value.NewObj(v.internString(lhs.Chars + rhs.Chars)))
+}
+
+// internString returns the canonical *object.String for chars, allocating it on first use.
+func (v *VM) internString(chars string) *object.String {
+	if str, ok := v.strings[chars]; ok {
+		return str
+	}
+
+	str := object.NewString(chars)
+	v.track(str)
+	v.strings[chars] = str
+
+	return str
+}
+
+func asString(val value.Value) (*object.String, bool) {
+	if !val.IsObj() {
+		return nil, false
+	}
+
+	str, ok := val.AsObj().(*object.String)
+
+	return str, ok
+}
+
+func asInstance(val value.Value) (*object.Instance, bool) {
+	if !val.IsObj() {
+		return nil, false
+	}
+
+	instance, ok := val.AsObj().(*object.Instance)
+
+	return instance, ok
+}
+
+func asList(val value.Value) (*object.List, bool) {
+	if !val.IsObj() {
+		return nil, false
+	}
+
+	list, ok := val.AsObj().(*object.List)
+
+	return list, ok
+}
+
+func asMap(val value.Value) (*object.Map, bool) {
+	if !val.IsObj() {
+		return nil, false
+	}
+
+	m, ok := val.AsObj().(*object.Map)
+
+	return m, ok
+}
+
+func asModule(val value.Value) (*object.Module, bool) {
+	if !val.IsObj() {
+		return nil, false
+	}
+
+	module, ok := val.AsObj().(*object.Module)
+
+	return module, ok
+}
+
+func isGenerator(val value.Value) bool {
+	_, ok := asGenerator(val)
+
+	return ok
+}
+
+func isList(val value.Value) bool {
+	_, ok := asList(val)
+
+	return ok
+}
+
+func isMap(val value.Value) bool {
+	_, ok := asMap(val)
+
+	return ok
+}
+
+func isModule(val value.Value) bool {
+	_, ok := asModule(val)
+
+	return ok
+}
+
+func isString(val value.Value) bool {
+	_, ok := asString(val)
+
+	return ok
 }
 
 func (v *VM) readByte() uint8 {
-	b := v.Chunk.Read(v.IP)
-	v.IP++
+	frame := v.frame()
+	b := frame.Closure.Function.Chunk.Read(frame.IP)
+	frame.IP++
 
 	return b
 }
 
+func (v *VM) readConstant(constantID int) value.Value {
+	return v.frame().Closure.Function.Chunk.GetConstant(constantID)
+}
+
+// readString reads a word operand and returns the string constant it refers to.
+func (v *VM) readString() *object.String {
+	name, _ := asString(v.readConstant(int(v.readWord())))
+
+	return name
+}
+
 func (v *VM) readWord() uint16 {
-	w := v.Chunk.ReadWord(v.IP)
-	v.IP += 2
+	frame := v.frame()
+	w := frame.Closure.Function.Chunk.ReadWord(frame.IP)
+	frame.IP += 2
 
 	return w
 }
@@ -1,17 +1,24 @@
 package vm_test
 
 import (
+	"bytes"
+	"errors"
+	"strings"
 	"testing"
+	"testing/fstest"
 
 	"github.com/stretchr/testify/assert"
 
+	"github.com/meanguy/automato/internal/mem"
+	"github.com/meanguy/automato/internal/object"
+	"github.com/meanguy/automato/internal/opcode"
 	"github.com/meanguy/automato/internal/value"
 	"github.com/meanguy/automato/internal/vm"
 )
 
 func TestVMPushAndPopValue(t *testing.T) {
 	vm := vm.NewVM()
-	expected := value.Value(3.14159)
+	expected := value.NewNumber(3.14159)
 
 	vm.Push(expected)
 	actual := vm.Pop()
@@ -20,9 +27,1951 @@ func TestVMPushAndPopValue(t *testing.T) {
 }
 
 func TestVMInterpretSource(t *testing.T) {
-	vm := vm.NewVM()
-	expected := value.Value(5)
+	var out bytes.Buffer
+
+	vm := vm.NewVM(vm.WithStdout(&out))
+
+	assert.NoError(t, vm.Interpret("print 3+2;"))
+	assert.Equal(t, "5\n", out.String())
+	assert.Empty(t, vm.Stack)
+}
+
+func TestVMInterpretExpressions(t *testing.T) {
+	testCases := []struct {
+		source   string
+		expected string
+	}{
+		{"true", "true"},
+		{"false", "false"},
+		{"nil", "nil"},
+		{"!true", "false"},
+		{"!nil", "true"},
+		{"!0", "false"},
+		{"1 == 1", "true"},
+		{"1 != 1", "false"},
+		{"nil == false", "false"},
+		{"nil == nil", "true"},
+		{"2 > 1", "true"},
+		{"2 >= 2", "true"},
+		{"2 < 1", "false"},
+		{"1 <= 2", "true"},
+		{"1 + 2 * 3 == 7", "true"},
+		{"1 - 2 - 3", "-4"},
+		{"8 / 4 / 2", "1"},
+		{"!(5 - 4 > 3 * 2 == !nil)", "true"},
+		{"7 / 2", "3"},
+		{"-7 / 2", "-3"},
+		{"7.0 / 2", "3.500000"},
+		{"1 + 0.5", "1.500000"},
+		{"2 * 1.5 == 3", "true"},
+		{"1 == 1.0", "true"},
+		{"1 < 1.5", "true"},
+		{"7 % 3", "1"},
+		{"-7 % 3", "-1"},
+		{"7.5 % 2", "1.500000"},
+		{"1 + 6 % 4 * 2", "5"},
+		{"-(3)", "-3"},
+		{"-1.5", "-1.500000"},
+		{"6 & 3", "2"},
+		{"6 | 3", "7"},
+		{"6 ^ 3", "5"},
+		{"~5", "-6"},
+		{"1 << 4", "16"},
+		{"-16 >> 2", "-4"},
+		{"1 | 2 ^ 3 & 4 << 1", "3"},
+		{"1 << 2 + 1", "8"},
+		{"9223372036854775807 + 1", "-9223372036854775808"},
+		{`"foo"`, "foo"},
+		{`""`, ""},
+		{`"foo" + "bar"`, "foobar"},
+		{`"a" + "b" + "c"`, "abc"},
+		{`"foo" == "foo"`, "true"},
+		{`"foo" + "bar" == "foobar"`, "true"},
+		{`"foo" != "bar"`, "true"},
+		{`"1" == 1`, "false"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.source, func(t *testing.T) {
+			actual, err := interpret(t, "print "+tc.source+";")
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected+"\n", actual)
+		})
+	}
+}
+
+func TestVMInterpretStatements(t *testing.T) {
+	testCases := []struct {
+		source   string
+		expected string
+	}{
+		{"", ""},
+		{"1 + 2;", ""},
+		{`print "one"; print "two";`, "one\ntwo\n"},
+		{"1;\nprint 2;\n3;", "2\n"},
+		{`var greeting = "hello"; print greeting;`, "hello\n"},
+		{"var empty; print empty;", "nil\n"},
+		{"var a = 1; a = a + 1; print a;", "2\n"},
+		{"var a = 1; var b = 2; a = b = 3; print a; print b;", "3\n3\n"},
+		{"var a = 1; var a = 2; print a;", "2\n"},
+		{`var a = "a"; var b = a + "b"; print b;`, "ab\n"},
+		{"{ var a = 1; print a; }", "1\n"},
+		{"var a = 1; { var a = 2; print a; } print a;", "2\n1\n"},
+		{"{ var a = 1; { var b = a + 1; a = b * 2; } print a; }", "4\n"},
+		{"var a = 1; { var b = a; b = 3; a = b; } print a;", "3\n"},
+		{"{ var a; print a; }", "nil\n"},
+		{"{}", ""},
+		{"if (true) print 1;", "1\n"},
+		{"if (false) print 1;", ""},
+		{"if (nil) print 1; else print 2;", "2\n"},
+		{`if (1 > 2) { print "a"; } else if (2 > 1) { print "b"; } else { print "c"; }`, "b\n"},
+		{"var i = 0; while (i < 3) { print i; i = i + 1; }", "0\n1\n2\n"},
+		{"while (false) print 1;", ""},
+		{"for (var i = 0; i < 2; i = i + 1) print i;", "0\n1\n"},
+		{"var i = 5; for (; i > 3;) i = i - 1; print i;", "3\n"},
+		{"var n = 0; for (n = 3; n < 4; n = n + 1) {} print n;", "4\n"},
+		{"for (var i = 0; i < 1; i = i + 1) { var i = 10; print i; }", "10\n"},
+		{"print true and 1;", "1\n"},
+		{"print false and 1;", "false\n"},
+		{"print nil or 2;", "2\n"},
+		{"print 1 or 2;", "1\n"},
+		{"print nil or false and true;", "false\n"},
+		{"var a = 1; false and (a = 2); true or (a = 3); print a;", "1\n"},
+		{"fun f() {} print f;", "<fn f>\n"},
+		{"fun f() {} print f();", "nil\n"},
+		{"fun add(a, b) { return a + b; } print add(1, 2);", "3\n"},
+		{"fun f() { return; } print f();", "nil\n"},
+		{
+			"fun fib(n) { if (n < 2) return n; return fib(n - 2) + fib(n - 1); } print fib(10);",
+			"55\n",
+		},
+		{"{ fun local() { return 1; } print local(); }", "1\n"},
+		{"fun f(a) { var b = a * 2; { var c = b + 1; return c; } } print f(2); print f(3);", "5\n7\n"},
+		{"fun f() { print \"in f\"; } var g = f; g();", "in f\n"},
+		{"{ fun local(n) { if (n > 0) return local(n - 1); return n; } print local(3); }", "0\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.source, func(t *testing.T) {
+			actual, err := interpret(t, tc.source)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestVMInterpretCompileErrors(t *testing.T) {
+	testCases := []struct {
+		source   string
+		expected string
+	}{
+		{"1 + 2", "[line 1] error at end: expect ';' after expression"},
+		{"print 1", "[line 1] error at end: expect ';' after value"},
+		{"print;", "[line 1] error at ';': expect expression"},
+		{"print 9223372036854775808;", "[line 1] error at '9223372036854775808': integer literal out of range"},
+		{"1;\n2 3;", "[line 2] error at '3': expect ';' after expression"},
+		{"var = 1;", "[line 1] error at '=': expect variable name"},
+		{"var a = 1", "[line 1] error at end: expect ';' after variable declaration"},
+		{"var a; var b; a + b = 3;", "[line 1] error at '=': invalid assignment target"},
+		{"var a; -a = 3;", "[line 1] error at '=': invalid assignment target"},
+		{"{ var a = a; }", "[line 1] error at 'a': can't read local variable in its own initializer"},
+		{"{ var a = 1; var a = 2; }", "[line 1] error at 'a': already a variable with this name in this scope"},
+		{"{ print 1;", "[line 1] error at end: expect '}' after block"},
+		{"if true print 1;", "[line 1] error at 'true': expect '(' after 'if'"},
+		{"while (true print 1;", "[line 1] error at 'print': expect ')' after condition"},
+		{"for (;;", "[line 1] error at end: expect expression"},
+		{"var a; var b; a or b = 1;", "[line 1] error at '=': invalid assignment target"},
+		{"return 1;", "[line 1] error at 'return': can't return from top-level code"},
+		{"fun () {}", "[line 1] error at '(': expect function name"},
+		{"fun f(a b) {}", "[line 1] error at 'b': expect ')' after parameters"},
+		{"fun f() print 1;", "[line 1] error at 'print': expect '{' before function body"},
+		{"f(1 2);", "[line 1] error at '2': expect ')' after arguments"},
+		{"print this;", "[line 1] error at 'this': can't use 'this' outside of a class"},
+		{"fun f() { return this; }", "[line 1] error at 'this': can't use 'this' outside of a class"},
+		{"class A { init() { return 1; } }", "[line 1] error at 'return': can't return a value from an initializer"},
+		{"class { }", "[line 1] error at '{': expect class name"},
+		{"class A { var x; }", "[line 1] error at 'var': expect method name"},
+		{"print [1, 2;", "[line 1] error at ';': expect ']' after list elements"},
+		{"var xs; print xs[0;", "[line 1] error at ';': expect ']' after index"},
+		{"var xs; xs[0] + 1 = 2;", "[line 1] error at '=': invalid assignment target"},
+		{`print {"a" 1};`, "[line 1] error at '1': expect ':' after map key"},
+		{`print "a ${1 2}";`, "[line 1] error at '2': expect end of string interpolation"},
+		{`print "bad \q escape";`, `[line 1] error: invalid escape sequence '\q'`},
+		{"try { print 1; }", "[line 1] error at end: expect 'catch' or 'finally' after try block"},
+		{"try print 1;", "[line 1] error at 'print': expect '{' after 'try'"},
+		{"try {} catch (1) {}", "[line 1] error at '1': expect exception variable name"},
+		{"try {} catch (e {}", "[line 1] error at '{': expect ')' after exception variable"},
+		{"try {} finally print 1;", "[line 1] error at 'print': expect '{' after 'finally'"},
+		{"throw 1", "[line 1] error at end: expect ';' after thrown value"},
+		{"import util;", "[line 1] error at 'util': expect module path after 'import'"},
+		{"for (x in [1] print x;", "[line 1] error at 'print': expect ')' after for-in iterable"},
+		{"yield 1;", "[line 1] error at 'yield': can't yield from top-level code"},
+		{"class A { init() { yield 1; } }", "[line 1] error at 'yield': can't yield from an initializer"},
+		{"fun f() { yield 1 }", "[line 1] error at '}': expect ';' after yielded value"},
+		{"for (var 1 in [1]) print x;", "[line 1] error at '1': expect variable name"},
+		{`import "util.ato";`, "[line 1] error at ';': expect 'as' after module path"},
+		{`import "util.ato" as 1;`, "[line 1] error at '1': expect module name"},
+		{`import "util.ato" as util`, "[line 1] error at end: expect ';' after import"},
+		{"spawn 1;", "[line 1] error at '1': expect a call after 'spawn'"},
+		{"fun f() {} spawn f().x;", "[line 1] error at 'x': expect a call after 'spawn'"},
+		{"fun f() {} spawn f()", "[line 1] error at end: expect ';' after spawned call"},
+		{"fun g() {} spawn false and g();", "[line 1] error at 'and': expect a call after 'spawn'"},
+		{"fun f() {} fun g() {} spawn f() or g();", "[line 1] error at 'or': expect a call after 'spawn'"},
+		{"fun f() {} spawn f() + 1;", "[line 1] error at '+': expect a call after 'spawn'"},
+		{"fun f() {} spawn -f();", "[line 1] error at ')': expect a call after 'spawn'"},
+		{"print select;", "[line 1] error at ';': expect '(' after 'select'"},
+		{"print match 1 1 => 1 };", "[line 1] error at '1': expect '{' after match value"},
+		{"print match 1 { 1 2 };", "[line 1] error at '2': expect '=>' after pattern"},
+		{"print match 1 { 1 => 2;", "[line 1] error at ';': expect '}' after match arms"},
+		{"print match 1 { + => 1 };", "[line 1] error at '+': expect pattern"},
+		{"print match 1 { -true => 1 };", "[line 1] error at 'true': expect pattern"},
+		{`print match 1 { "a".."b" => 1 };`, `[line 1] error at '"b"': range pattern bounds must be numbers`},
+		{"print match 1 { [x, x] => 1 };", "[line 1] error at 'x': already a variable with this name in this scope"},
+		{"print match 1 { [1 => 1 };", "[line 1] error at '=>': expect ']' after list pattern"},
+		{`print match 1 { {"a" 1} => 1 };`, "[line 1] error at '1': expect ':' after map pattern key"},
+		{"print match 1 { A { 1 } => 1 };", "[line 1] error at '1': expect field name"},
+		{"print match 1 { A { x => 1 };", "[line 1] error at '=>': expect '}' after class pattern fields"},
+		{"{ var a = match 1 { _ => a }; }", "[line 1] error at 'a': can't read local variable in its own initializer"},
+		{"var f = fun {};", "[line 1] error at '{': expect '(' after 'fun'"},
+		{"var f = fun (a b) {};", "[line 1] error at 'b': expect ')' after parameters"},
+		{"var f = fun (a) a;", "[line 1] error at 'a': expect '{' before function body"},
+		{"var a; var b; var f = (a, b) a;", "[line 1] error at ',': expected ')' after expression"},
+		{"var a; var f = (a, 1) => a;", "[line 1] error at ',': expected ')' after expression"},
+		{"var f = () => ;", "[line 1] error at ';': expect expression"},
+		{"print \"a ${\n1 +\n", "[line 1] error: unterminated string interpolation"},
+		{"print \"a\n${1}\nb;", "[line 2] error: unterminated string"},
+		{`print {"a": 1;`, "[line 1] error at ';': expect '}' after map entries"},
+		{`{"a": 1};`, "[line 1] error at ':': expect ';' after expression"},
+		{"var a; a.1;", "[line 1] error at '1': expect property name after '.'"},
+		{"class A < A {}", "[line 1] error at 'A': a class can't inherit from itself"},
+		{"print super.f;", "[line 1] error at 'super': can't use 'super' outside of a class"},
+		{"class A { f() { super.f(); } }", "[line 1] error at 'super': can't use 'super' in a class with no superclass"},
+		{"class A {} class B < A { f() { super; } }", "[line 1] error at ';': expect '.' after 'super'"},
+		{"class A < {}", "[line 1] error at '{': expect superclass name"},
+		{
+			"if (true) {" + strings.Repeat("1;", 20000) + "}",
+			"[line 1] error at '}': too much code to jump over",
+		},
+		{
+			"while (false) {" + strings.Repeat("1;", 20000) + "}",
+			"[line 1] error at '}': loop body too large",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.source, func(t *testing.T) {
+			_, err := interpret(t, tc.source)
+
+			assert.EqualError(t, err, tc.expected)
+		})
+	}
+}
+
+func TestVMInterpretRuntimeErrors(t *testing.T) {
+	testCases := []struct {
+		source  string
+		message string
+		line    int
+	}{
+		{"-true;", "operand must be a number", 1},
+		{"1 +\n nil;", "operands must be two numbers or two strings", 2},
+		{`"foo" + 1;`, "operands must be two numbers or two strings", 1},
+		{"1 <\n\n false;", "operands must be numbers", 3},
+		{"nil * 2;", "operands must be numbers", 1},
+		{"1 / 0;", "division by zero", 1},
+		{"for (x in 42) print x;", "can't iterate over '42'", 1},
+		{"fun gen() { yield 1; }\ngen().next(1);", "expected 0 arguments but got 1", 2},
+		{"var g;\nfun gen() { g.next(); yield 1; }\ng = gen(); g.next();", "generator is already running", 2},
+		{"fun gen() { yield 1; } gen().missing();", "undefined property 'missing'", 1},
+		{"for (x in nil) print x;", "can't iterate over 'nil'", 1},
+		{"var xs = [1];\nfor (x in xs)\n  xs.push(x);", "list changed size during iteration", 2},
+		{"var xs = [1, 2];\nfor (x in xs) { xs.pop(); xs.push(x); }", "list changed size during iteration", 2},
+		{`var m = {"a": 1}; for (k in m) m["b"] = 2;`, "map changed size during iteration", 1},
+		{`var m = {"a": 1, "b": 2}; for (k in m) m.delete(k);`, "map changed size during iteration", 1},
+		{`print 1.."a";`, "range bounds must be integers", 1},
+		{"print 1.5..2;", "range bounds must be integers", 1},
+		{"class Empty {} for (x in Empty()) print x;", "undefined property 'next'", 1},
+		{"class Bad { iter() { return 1; } } for (x in Bad()) print x;", "can't iterate over '1'", 1},
+		{"1.5 / 0.0;", "division by zero", 1},
+		{"\n5 % 0;", "division by zero", 2},
+		{"1.5 & 1;", "operands must be integers", 1},
+		{"~1.5;", "operand must be an integer", 1},
+		{"1 << 64;", "shift count 64 out of range", 1},
+		{"1 >> -1;", "shift count -1 out of range", 1},
+		{"print undefined;", "undefined variable 'undefined'", 1},
+		{"var notfn = 1; notfn();", "can only call functions and classes", 1},
+		{"fun f(a) {}\nf();", "expected 1 arguments but got 0", 2},
+		{"fun f() { f(); }\nf();", "stack overflow", 1},
+		{"class A {} A(1);", "expected 0 arguments but got 1", 1},
+		{"class A { init(a) {} } A();", "expected 1 arguments but got 0", 1},
+		{"class A {} print A().missing;", "undefined property 'missing'", 1},
+		{"class A {} A().missing();", "undefined property 'missing'", 1},
+		{"var a = 1; print a.field;", "only instances have properties", 1},
+		{"var a = 1; a.field = 2;", "only instances have fields", 1},
+		{`"str".len();`, "only instances have methods", 1},
+		{"var NotClass = 1; class A < NotClass {}", "superclass must be a class", 1},
+		{"class A {} class B < A { f() { return super.missing(); } } B().f();", "undefined property 'missing'", 1},
+		{"\nundefined = 1;", "undefined variable 'undefined'", 2},
+		{"print [1, 2][2];", "list index 2 out of range", 1},
+		{"print [1, 2][-3];", "list index -3 out of range", 1},
+		{`print [1, 2]["0"];`, "list index must be an integer", 1},
+		{"var xs = [];\nxs[0] = 1;", "list index 0 out of range", 2},
+		{"var a = 1; print a[0];", "only lists and maps can be indexed", 1},
+		{"[].pop();", "pop from empty list", 1},
+		{"[1].push();", "expected 1 arguments but got 0", 1},
+		{"[1].insert(3, 1);", "list index 3 out of range", 1},
+		{"[1].remove(1);", "list index 1 out of range", 1},
+		{"[1].missing();", "undefined property 'missing'", 1},
+		{`print {"a": 1}["b"];`, "undefined key 'b'", 1},
+		{"print {[]: 1};", "map keys must be strings, numbers, booleans or nil", 1},
+		{"var m = {};\nm[m] = 1;", "map keys must be strings, numbers, booleans or nil", 2},
+		{"print {}.has([]);", "map keys must be strings, numbers, booleans or nil", 1},
+		{"print {}.missing();", "undefined property 'missing'", 1},
+		{"var c = channel();\nc.recv();", "deadlock: every fiber is blocked", 2},
+		{"fun f(c) { c.recv(); }\nspawn f(channel());", "deadlock: every fiber is blocked", 1},
+		{"fun f(c) {\n  c.recv();\n}\nfun g() {}\nspawn f(channel()); spawn g();", "deadlock: every fiber is blocked", 2},
+		{"var c = channel(); c.close();\nc.send(1);", "send on closed channel", 2},
+		{"var c = channel();\nfun f() {\n  c.send(1);\n}\nspawn f(); spawn c.close();", "send on closed channel", 3},
+		{"var c = channel(); c.close(); c.close();", "channel is already closed", 1},
+		{"channel(-1);", "channel capacity must be a non-negative integer", 1},
+		{"channel(1, 2);", "expected 0 or 1 arguments", 1},
+		{"channel().missing();", "undefined property 'missing'", 1},
+		{"select();", "select needs at least one channel", 1},
+		{"select(channel(), 1);", "can only select from channels", 1},
+		{"var x = 3;\nprint match x { 1 => 2 };", "no match for '3'", 2},
+		{`print match [1, "a"] { [_] => 1 };`, "no match for '[1, a]'", 1},
+		{"var A = 1; print match 1 { A {} => 1 };", "class pattern must name a class", 1},
+		{"fun f() {\n  1 + nil;\n}\nspawn f();", "operands must be two numbers or two strings", 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.source, func(t *testing.T) {
+			var rtErr *vm.RuntimeError
+
+			vm := vm.NewVM()
+			err := vm.Interpret(tc.source)
+			assert.True(t, errors.As(err, &rtErr))
+			assert.Equal(t, tc.message, rtErr.Message)
+			assert.Equal(t, tc.line, rtErr.Line)
+			assert.Empty(t, vm.Stack)
+		})
+	}
+}
+
+func TestVMInterpretChunkRuntimeErrors(t *testing.T) {
+	testCases := []struct {
+		name    string
+		code    []opcode.OpCode
+		message string
+	}{
+		{"empty chunk", []opcode.OpCode{}, "unexpected end of chunk"},
+		{"unknown opcode", []opcode.OpCode{0xff}, "unknown opcode 255"},
+		{"stack underflow", []opcode.OpCode{opcode.OpPop, opcode.OpPop, opcode.OpReturn}, "stack underflow"},
+		{"missing return", []opcode.OpCode{opcode.OpNil}, "unexpected end of chunk"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var rtErr *vm.RuntimeError
+
+			vm := vm.NewVM()
+			chunk := mem.Chunk{}
+
+			for _, op := range tc.code {
+				chunk.WriteOp(op, 7)
+			}
+
+			err := vm.InterpretChunk(&chunk)
+			assert.True(t, errors.As(err, &rtErr))
+			assert.Equal(t, tc.message, rtErr.Message)
+		})
+	}
+}
+
+func TestVMReusableAfterRuntimeError(t *testing.T) {
+	var out bytes.Buffer
+
+	vm := vm.NewVM(vm.WithStdout(&out))
+
+	assert.Error(t, vm.Interpret("1 + true;"))
+	assert.Empty(t, vm.Stack)
+
+	assert.NoError(t, vm.Interpret("print 1 + 2;"))
+	assert.Equal(t, "3\n", out.String())
+}
+
+func TestVMReusableAfterRuntimeErrorClosesUpvalues(t *testing.T) {
+	var out bytes.Buffer
+
+	vm := vm.NewVM(vm.WithStdout(&out))
+
+	assert.Error(t, vm.Interpret(`
+		var get;
+		fun f() {
+			var s = "captured";
+			fun g() { return s; }
+			get = g;
+			1 + true;
+		}
+		f();`))
+	assert.NoError(t, vm.Interpret(`{ var p1 = "p1"; var p2 = "p2"; print get(); }`))
+	assert.Equal(t, "captured\n", out.String())
+}
+
+func TestVMInterpretClosures(t *testing.T) {
+	testCases := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{
+			name: "counter",
+			source: `
+				fun counter() {
+					var count = 0;
+					fun increment() { count = count + 1; return count; }
+					return increment;
+				}
+				var a = counter();
+				var b = counter();
+				a(); a();
+				print a();
+				print b();`,
+			expected: "3\n1\n",
+		},
+		{
+			name: "shared upvalue",
+			source: `
+				var get; var set;
+				fun pair() {
+					var value = "initial";
+					fun g() { return value; }
+					fun s(v) { value = v; }
+					get = g; set = s;
+				}
+				pair();
+				set("updated");
+				print get();`,
+			expected: "updated\n",
+		},
+		{
+			name: "captured while open",
+			source: `
+				{
+					var x = "before";
+					fun f() { x = "after"; }
+					f();
+					print x;
+				}`,
+			expected: "after\n",
+		},
+		{
+			name: "closed by block",
+			source: `
+				var f;
+				{
+					var local = "block";
+					fun g() { return local; }
+					f = g;
+				}
+				print f();`,
+			expected: "block\n",
+		},
+		{
+			name: "nested capture",
+			source: `
+				fun outer() {
+					var x = "outer";
+					fun middle() {
+						fun inner() { return x; }
+						return inner;
+					}
+					return middle;
+				}
+				print outer()()();`,
+			expected: "outer\n",
+		},
+		{
+			name: "loop variable per iteration",
+			source: `
+				var fs0; var fs1;
+				for (var i = 0; i < 2; i = i + 1) {
+					var j = i;
+					fun f() { return j; }
+					if (j == 0) fs0 = f; else fs1 = f;
+				}
+				print fs0();
+				print fs1();`,
+			expected: "0\n1\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := interpret(t, tc.source)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestVMInterpretClasses(t *testing.T) {
+	testCases := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{
+			name:     "class and instance",
+			source:   "class Service {} print Service; print Service();",
+			expected: "Service\n<Service instance>\n",
+		},
+		{
+			name:     "fields",
+			source:   `class Box {} var b = Box(); b.value = "contents"; print b.value; print b.value = 2;`,
+			expected: "contents\n2\n",
+		},
+		{
+			name: "methods and this",
+			source: `
+				class Greeter {
+					greet(name) { return this.greeting + ", " + name; }
+				}
+				var g = Greeter();
+				g.greeting = "hello";
+				print g.greet("world");`,
+			expected: "hello, world\n",
+		},
+		{
+			name: "bound method keeps receiver",
+			source: `
+				class Counter {
+					init() { this.count = 0; }
+					increment() { this.count = this.count + 1; return this.count; }
+				}
+				var c = Counter();
+				var inc = c.increment;
+				inc(); inc();
+				print inc;
+				print c.count;`,
+			expected: "<fn increment>\n2\n",
+		},
+		{
+			name: "initializer",
+			source: `
+				class Deploy {
+					init(service, env) { this.service = service; this.env = env; }
+					describe() { return this.service + " to " + this.env; }
+				}
+				print Deploy("api", "prod").describe();`,
+			expected: "api to prod\n",
+		},
+		{
+			name:     "initializer returns instance",
+			source:   "class A { init() { this.x = 1; return; } } var a = A(); print a.init() == a;",
+			expected: "true\n",
+		},
+		{
+			name: "field shadows method",
+			source: `
+				class A { f() { return "method"; } }
+				fun field() { return "field"; }
+				var a = A();
+				a.f = field;
+				print a.f();`,
+			expected: "field\n",
+		},
+		{
+			name: "closure captures this",
+			source: `
+				class A {
+					init(name) { this.name = name; }
+					getter() { fun get() { return this.name; } return get; }
+				}
+				print A("captured").getter()();`,
+			expected: "captured\n",
+		},
+		{
+			name: "inherited methods",
+			source: `
+				class Base { hello() { return "hello from " + this.name; } }
+				class Derived < Base { init() { this.name = "derived"; } }
+				print Derived().hello();`,
+			expected: "hello from derived\n",
+		},
+		{
+			name: "override and super call",
+			source: `
+				class A { describe() { return "A"; } }
+				class B < A { describe() { return "B > " + super.describe(); } }
+				class C < B { describe() { return "C > " + super.describe(); } }
+				print C().describe();`,
+			expected: "C > B > A\n",
+		},
+		{
+			name: "super method access",
+			source: `
+				class A { init(x) { this.x = x; } get() { return this.x; } }
+				class B < A {
+					init(x) { super.init(x * 2); }
+					get() { var m = super.get; return m() + 1; }
+				}
+				print B(2).get();`,
+			expected: "5\n",
+		},
+		{
+			name: "methods copied at definition",
+			source: `
+				class A { f() { return "original"; } }
+				class B < A {}
+				class A2 < A { f() { return "changed"; } }
+				print B().f();`,
+			expected: "original\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := interpret(t, tc.source)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+
+			actual, err = interpret(t, tc.source, vm.WithStressGC())
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestVMRuntimeErrorStackTrace(t *testing.T) {
+	var rtErr *vm.RuntimeError
+
+	source := "fun inner() {\n  return -nil;\n}\nfun outer() {\n  inner();\n}\nouter();"
+
+	_, err := interpret(t, source)
+	assert.True(t, errors.As(err, &rtErr))
+	assert.Equal(t, 2, rtErr.Line)
+	assert.Equal(t, []vm.TraceEntry{
+		{Function: "inner()", Line: 2},
+		{Function: "outer()", Line: 5},
+		{Function: "script", Line: 7},
+	}, rtErr.Trace)
+	assert.EqualError(t, err, "runtime error: operand must be a number\n"+
+		"[line 2] in inner()\n[line 5] in outer()\n[line 7] in script")
+}
+
+func TestVMRuntimeErrorStackTraceInMatch(t *testing.T) {
+	var rtErr *vm.RuntimeError
+
+	_, err := interpret(t, "fun f(x) {\n  return match x { n => -n };\n}\nf(nil);")
+	assert.True(t, errors.As(err, &rtErr))
+	assert.Equal(t, []vm.TraceEntry{
+		{Function: "f()", Line: 2},
+		{Function: "script", Line: 4},
+	}, rtErr.Trace)
+}
+
+func TestVMStressGC(t *testing.T) {
+	testCases := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{
+			name: "string concatenation",
+			source: `
+				var s = "";
+				for (var i = 0; i < 10; i = i + 1) { s = s + "a" + "b"; }
+				print s == "abababababababababab";`,
+			expected: "true\n",
+		},
+		{
+			name: "closures over closed upvalues",
+			source: `
+				fun make(prefix) {
+					var suffix = "!";
+					fun greet(name) { return prefix + name + suffix; }
+					return greet;
+				}
+				var hello = make("hello ");
+				for (var i = 0; i < 3; i = i + 1) { make("garbage"); }
+				print hello("world");`,
+			expected: "hello world!\n",
+		},
+		{
+			name: "recursion",
+			source: `
+				fun fib(n) { if (n < 2) return n; return fib(n - 2) + fib(n - 1); }
+				print fib(12);`,
+			expected: "144\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := interpret(t, tc.source, vm.WithStressGC())
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestVMCollectGarbage(t *testing.T) {
+	var out bytes.Buffer
+
+	vm := vm.NewVM(vm.WithStdout(&out))
+
+	assert.NoError(t, vm.Interpret(`var kept = "kept" + "!";`))
+	vm.CollectGarbage()
+
+	objects := vm.HeapObjects()
+	bytes := vm.BytesAllocated()
+
+	assert.NoError(t, vm.Interpret(`{ var garbage = "gar" + "bage"; fun f() { return garbage; } }`))
+	assert.Greater(t, vm.HeapObjects(), objects)
+
+	vm.CollectGarbage()
+	assert.Equal(t, objects, vm.HeapObjects())
+	assert.Equal(t, bytes, vm.BytesAllocated())
+
+	assert.NoError(t, vm.Interpret("print kept;"))
+	assert.Equal(t, "kept!\n", out.String())
+}
+
+func TestVMCollectGenerators(t *testing.T) {
+	var out bytes.Buffer
+
+	vm := vm.NewVM(vm.WithStdout(&out))
+
+	assert.NoError(t, vm.Interpret(`
+		fun gen() {
+			var local = "lo" + "cal";
+			fun f() { return local; }
+			yield f;
+			yield local;
+		}`))
+	vm.CollectGarbage()
+
+	objects := vm.HeapObjects()
+
+	assert.NoError(t, vm.Interpret("{ var g = gen(); print g.next()(); }"))
+	assert.Greater(t, vm.HeapObjects(), objects)
+
+	vm.CollectGarbage()
+	assert.Equal(t, objects, vm.HeapObjects())
+
+	// a suspended generator keeps its frame alive, along with the upvalues pointing into it.
+	assert.NoError(t, vm.Interpret("var kept = gen(); var f = kept.next();"))
+	vm.CollectGarbage()
+	assert.NoError(t, vm.Interpret("print f(); print kept.next();"))
+	assert.Equal(t, "local\nlocal\nlocal\n", out.String())
+}
+
+func TestVMGlobalsPersistAcrossInterpret(t *testing.T) {
+	var out bytes.Buffer
+
+	vm := vm.NewVM(vm.WithStdout(&out))
+
+	assert.NoError(t, vm.Interpret(`var name = "automato";`))
+	assert.Error(t, vm.Interpret("print missing;"))
+	assert.NoError(t, vm.Interpret("name = name + \"!\";"))
+	assert.NoError(t, vm.Interpret("print name;"))
+	assert.Equal(t, "automato!\n", out.String())
+}
+
+func TestVMInterpretLists(t *testing.T) {
+	testCases := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{"empty literal", "print [];", "[]\n"},
+		{"literal", `print [1, "two", nil, [3.5]];`, "[1, two, nil, [3.500000]]\n"},
+		{"index", "var xs = [1, 2, 3]; print xs[0] + xs[2];", "4\n"},
+		{"negative index", "var xs = [1, 2, 3]; print xs[-1]; print xs[-3];", "3\n1\n"},
+		{"index expression", "var xs = [10, 20, 30]; var i = 1; print xs[i + 1];", "30\n"},
+		{"nested index", "var grid = [[1, 2], [3, 4]]; print grid[1][0];", "3\n"},
+		{"assign", "var xs = [1, 2, 3]; xs[1] = 5; print xs;", "[1, 5, 3]\n"},
+		{"assign negative", "var xs = [1, 2, 3]; xs[-1] = 0; print xs;", "[1, 2, 0]\n"},
+		{"assignment value", "var xs = [1]; print xs[0] = 2;", "2\n"},
+		{"chained assignment", "var xs = [1, 2]; xs[0] = xs[1] = 7; print xs;", "[7, 7]\n"},
+		{"index call result", "fun f() { return [1, 2]; } print f()[1];", "2\n"},
+		{"push and len", "var xs = []; xs.push(1); xs.push(2); print xs.len(); print xs;", "2\n[1, 2]\n"},
+		{"pop", "var xs = [1, 2]; print xs.pop(); print xs;", "2\n[1]\n"},
+		{"insert", "var xs = [1, 3]; xs.insert(1, 2); xs.insert(3, 4); xs.insert(-4, 0); print xs;", "[0, 1, 2, 3, 4]\n"},
+		{"remove", "var xs = [1, 2, 3]; print xs.remove(-2); print xs;", "2\n[1, 3]\n"},
+		{"shared reference", "var a = [1]; var b = a; b.push(2); print a;", "[1, 2]\n"},
+		{"identity equality", "var a = [1]; print a == a; print [1] == [1];", "true\nfalse\n"},
+		{
+			"method on field",
+			"class Stack { init() { this.items = []; } } var s = Stack(); s.items.push(1); print s.items;",
+			"[1]\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := interpret(t, tc.source, vm.WithStressGC())
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestVMInterpretMaps(t *testing.T) {
+	testCases := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{"empty literal", "print {};", "{}\n"},
+		{
+			"literal",
+			`print {"name": "automato", "tags": ["a"], "nested": {"x": 1}};`,
+			"{name: automato, tags: [a], nested: {x: 1}}\n",
+		},
+		{"index", `var m = {"a": 1, "b": 2}; print m["a"] + m["b"];`, "3\n"},
+		{"computed key", `var k = "ke"; var m = {k + "y": true}; print m["key"];`, "true\n"},
+		{
+			"key types",
+			`var m = {1: "int", 2.5: "float", true: "bool", nil: "nil"}; print m[1] + m[2.5] + m[true] + m[nil];`,
+			"intfloatboolnil\n",
+		},
+		{"equal numbers share a key", "var m = {1: \"a\"}; m[1.0] = \"b\"; print m;", "{1: b}\n"},
+		{"assign new key", `var m = {}; m["a"] = 1; m["b"] = 2; print m;`, "{a: 1, b: 2}\n"},
+		{"assign existing key keeps order", `var m = {"a": 1, "b": 2}; m["a"] = 3; print m;`, "{a: 3, b: 2}\n"},
+		{"assignment value", `var m = {}; print m["a"] = 1;`, "1\n"},
+		{"has", `var m = {"a": nil}; print m.has("a"); print m.has("b");`, "true\nfalse\n"},
+		{
+			"delete",
+			`var m = {"a": 1, "b": 2, "c": 3}; print m.delete("b"); print m.delete("b"); print m;`,
+			"true\nfalse\n{a: 1, c: 3}\n",
+		},
+		{
+			"delete then set",
+			`var m = {"a": 1, "b": 2}; m.delete("a"); m["a"] = 1; print m["b"]; print m;`,
+			"2\n{b: 2, a: 1}\n",
+		},
+		{
+			"keys and values",
+			`var m = {"z": 1, "a": 2}; print m.keys(); print m.values(); print m.len();`,
+			"[z, a]\n[1, 2]\n2\n",
+		},
+		{
+			"nested",
+			`var cfg = {"db": {"port": 5432}}; cfg["db"]["port"] = 5433; print cfg["db"]["port"];`,
+			"5433\n",
+		},
+		{"block statement", "{ var m = {}; print m; }", "{}\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := interpret(t, tc.source, vm.WithStressGC())
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestVMInterpretStringInterpolation(t *testing.T) {
+	testCases := []struct {
+		source   string
+		expected string
+	}{
+		{`var service = "api"; var env = "prod"; print "deploy ${service} to ${env}";`, "deploy api to prod"},
+		{`print "${1 + 2}";`, "3"},
+		{`print "${1}${2}";`, "12"},
+		{
+			`print "sum: ${1 + 2} ratio: ${1 / 2.0} ok: ${true} nothing: ${nil}";`,
+			"sum: 3 ratio: 0.500000 ok: true nothing: nil",
+		},
+		{`print "list ${[1, 2]} map ${{"a": 1}}";`, "list [1, 2] map {a: 1}"},
+		{`var m = {"k": "v"}; print "got ${m["k"]}!";`, "got v!"},
+		{`var name = "x"; print "outer ${"inner ${name}"}";`, "outer inner x"},
+		{`fun f(a) { return a * 2; } print "f: ${f(21)}";`, "f: 42"},
+		{`print "a" + "${"b"}" + "c";`, "abc"},
+		{`print "${"$"}{}";`, "${}"},
+		{`print "\${literal}";`, "${literal}"},
+		{`var 名前 = "トマト"; print "\u{1F345} ${名前}\t\"ok\"";`, "🍅 トマト\t\"ok\""},
+		{`print "a\\b" == "a" + "\\" + "b";`, "true"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.source, func(t *testing.T) {
+			actual, err := interpret(t, tc.source, vm.WithStressGC())
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected+"\n", actual)
+		})
+	}
+}
+
+func TestVMInterpretExceptions(t *testing.T) {
+	testCases := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{
+			name:     "catch thrown value",
+			source:   `try { throw "boom"; print "unreachable"; } catch (e) { print "caught " + e; }`,
+			expected: "caught boom\n",
+		},
+		{
+			name:     "no exception skips catch",
+			source:   `try { print "ok"; } catch (e) { print "caught"; } print "after";`,
+			expected: "ok\nafter\n",
+		},
+		{
+			name:     "catch without variable",
+			source:   `try { throw 1; } catch { print "caught"; }`,
+			expected: "caught\n",
+		},
+		{
+			name:     "error object",
+			source:   `try { throw Error("bad input"); } catch (e) { print e.message; print e.trace; }`,
+			expected: "bad input\n[[line 1] in script]\n",
+		},
+		{
+			name: "runtime error is catchable",
+			source: `
+				fun divide(a, b) { return a / b; }
+				try { divide(1, 0); } catch (e) { print e.message; print e.trace; }`,
+			expected: "division by zero\n[[line 2] in divide(), [line 3] in script]\n",
+		},
+		{
+			name:     "undefined variable is catchable",
+			source:   `try { print missing; } catch (e) { print e.message; }`,
+			expected: "undefined variable 'missing'\n",
+		},
+		{
+			name:     "type error is catchable",
+			source:   `try { print 1 + nil; } catch (e) { print e.message; }`,
+			expected: "operands must be two numbers or two strings\n",
+		},
+		{
+			name: "stack overflow is catchable",
+			source: `
+				fun recurse() { recurse(); }
+				try { recurse(); } catch (e) { print e.message; }
+				print "recovered";`,
+			expected: "stack overflow\nrecovered\n",
+		},
+		{
+			name:     "value stack overflow is catchable",
+			source:   "try { print [" + strings.Repeat("0, ", vm.StackMax) + "0]; } catch (e) { print e.message; }",
+			expected: "stack overflow\n",
+		},
+		{
+			name: "unwinds call frames",
+			source: `
+				fun inner() { throw "deep"; }
+				fun outer() { inner(); print "unreachable"; }
+				try { outer(); } catch (e) { print e; }
+				fun after() { return "frames intact"; }
+				print after();`,
+			expected: "deep\nframes intact\n",
+		},
+		{
+			name: "restores locals",
+			source: `
+				{
+					var a = "a";
+					try { var b = "b"; var c = "c"; throw b + c; } catch (e) { print a + e; }
+					var d = "d";
+					print a + d;
+				}`,
+			expected: "abc\nad\n",
+		},
+		{
+			name: "closes upvalues",
+			source: `
+				var get;
+				try {
+					var captured = "captured";
+					fun f() { return captured; }
+					get = f;
+					throw nil;
+				} catch (e) {}
+				print get();`,
+			expected: "captured\n",
+		},
+		{
+			name:     "rethrow to outer handler",
+			source:   `try { try { throw "inner"; } catch (e) { throw e + "!"; } } catch (e) { print e; }`,
+			expected: "inner!\n",
+		},
+		{
+			name:     "finally after try",
+			source:   `try { print "try"; } finally { print "finally"; } print "after";`,
+			expected: "try\nfinally\nafter\n",
+		},
+		{
+			name:     "finally after catch",
+			source:   `try { throw 1; } catch (e) { print "catch"; } finally { print "finally"; }`,
+			expected: "catch\nfinally\n",
+		},
+		{
+			name:     "finally rethrows",
+			source:   `try { try { throw "x"; } finally { print "finally"; } } catch (e) { print "outer " + e; }`,
+			expected: "finally\nouter x\n",
+		},
+		{
+			name:     "finally after throwing catch",
+			source:   `try { try { throw 1; } catch (e) { throw 2; } finally { print "finally"; } } catch (e) { print e; }`,
+			expected: "finally\n2\n",
+		},
+		{
+			name: "finally on return",
+			source: `
+				fun f() {
+					try { return "returned"; } finally { print "finally"; }
+					return "unreachable";
+				}
+				print f();`,
+			expected: "finally\nreturned\n",
+		},
+		{
+			name: "nested finally on return",
+			source: `
+				fun f() {
+					try {
+						try { return 1; } finally { print "inner"; }
+					} finally {
+						print "outer";
+					}
+				}
+				print f();`,
+			expected: "inner\nouter\n1\n",
+		},
+		{
+			name: "return discards catch handlers",
+			source: `
+				fun f() { try { return 1; } catch (e) { print "wrong handler"; } }
+				f();
+				try { throw "later"; } catch (e) { print e; }`,
+			expected: "later\n",
+		},
+		{
+			name: "handler in caller",
+			source: `
+				fun risky(n) { if (n > 1) throw "too big"; return n; }
+				fun safe(n) { try { return risky(n); } catch (e) { return e; } }
+				print safe(1); print safe(2);`,
+			expected: "1\ntoo big\n",
+		},
+		{
+			name: "error subclass",
+			source: `
+				class NotFound < Error { init(name) { super.init(name + " not found"); this.name = name; } }
+				try { throw NotFound("config"); } catch (e) { print e.message; print e.name; print e.trace; }`,
+			expected: "config not found\nconfig\n[[line 3] in script]\n",
+		},
+		{
+			name: "loop with try",
+			source: `
+				var caught = 0;
+				for (var i = 0; i < 5; i = i + 1) {
+					try { if (i % 2 == 0) throw i; } catch (e) { caught = caught + 1; }
+				}
+				print caught;`,
+			expected: "3\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := interpret(t, tc.source, vm.WithStressGC())
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestVMUncaughtExceptions(t *testing.T) {
+	testCases := []struct {
+		source  string
+		message string
+		line    int
+		output  string
+	}{
+		{"\nthrow 42;", "uncaught exception: 42", 2, ""},
+		{`throw Error("broken");`, "broken", 1, ""},
+		{"fun f() {\n  throw \"from f\";\n}\nf();", "uncaught exception: from f", 2, ""},
+		{`try { throw "again"; } catch (e) { throw e; }`, "uncaught exception: again", 1, ""},
+		{"try {\n  throw 1;\n} finally {\n  print \"cleanup\";\n}", "uncaught exception: 1", 5, "cleanup\n"},
+		{"try { 1 / 0; } finally { print \"cleanup\"; }", "division by zero", 1, "cleanup\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.source, func(t *testing.T) {
+			var (
+				rtErr *vm.RuntimeError
+				out   bytes.Buffer
+			)
+
+			vm := vm.NewVM(vm.WithStdout(&out))
+			err := vm.Interpret(tc.source)
+			assert.True(t, errors.As(err, &rtErr))
+			assert.Equal(t, tc.message, rtErr.Message)
+			assert.Equal(t, tc.line, rtErr.Line)
+			assert.Equal(t, tc.output, out.String())
+			assert.Empty(t, vm.Stack)
+
+			assert.NoError(t, vm.Interpret(`try { throw 1; } catch (e) { print "reusable"; }`))
+		})
+	}
+}
+
+func TestVMInterpretForIn(t *testing.T) {
+	testCases := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{"list", "for (x in [1, 2, 3]) print x;", "1\n2\n3\n"},
+		{"empty list", `for (x in []) print x; print "done";`, "done\n"},
+		{"var loop variable", "for (var x in [1, 2]) print x;", "1\n2\n"},
+		{"map keys", `var m = {"a": 1, "b": 2}; for (k in m) print "${k}=${m[k]}";`, "a=1\nb=2\n"},
+		{"string", `for (c in "héy") print c;`, "h\né\ny\n"},
+		{"range", "for (i in 0..3) print i;", "0\n1\n2\n"},
+		{"empty range", `for (i in 3..0) print i; print "done";`, "done\n"},
+		{"range expression", "var n = 2; for (i in n - 1..n * 2) print i;", "1\n2\n3\n"},
+		{"print range", "print 1..5;", "1..5\n"},
+		{"nested", "for (i in 0..2) for (j in 0..2) print i * 10 + j;", "0\n1\n10\n11\n"},
+		{"assign elements", "var xs = [1, 2]; for (x in xs) xs[0] = x * 10; print xs;", "[20, 2]\n"},
+		{"overwrite map value", `var m = {"a": 1}; for (k in m) m[k] = 2; print m;`, "{a: 2}\n"},
+		{
+			name:     "closures capture each element",
+			source:   "var fs = []; for (x in [1, 2]) { fun f() { return x; } fs.push(f); } print fs[0]() + fs[1]();",
+			expected: "3\n",
+		},
+		{
+			name: "iterator",
+			source: `
+				class Countdown {
+					init(n) { this.n = n; }
+					next() {
+						if (this.n == 0) return nil;
+						this.n = this.n - 1;
+						return this.n;
+					}
+				}
+				for (i in Countdown(3)) print i;`,
+			expected: "2\n1\n0\n",
+		},
+		{
+			name: "iterable",
+			source: `
+				class Pair {
+					init(a, b) { this.a = a; this.b = b; }
+					iter() { return [this.a, this.b]; }
+				}
+				for (x in Pair("a", "b")) print x;`,
+			expected: "a\nb\n",
+		},
+		{
+			name: "iter returns iterator",
+			source: `
+				class Cursor {
+					init(items) { this.items = items; this.i = 0; }
+					next() {
+						if (this.i == this.items.len()) return nil;
+						this.i = this.i + 1;
+						return this.items[this.i - 1];
+					}
+				}
+				class Letters { iter() { return Cursor(["x", "y"]); } }
+				for (l in Letters()) print l;`,
+			expected: "x\ny\n",
+		},
+		{
+			name: "exception in iterator",
+			source: `
+				class Broken { next() { throw "broken"; } }
+				fun f() { for (x in Broken()) print x; }
+				try { f(); } catch (e) { print e; }
+				for (x in [1]) print x;`,
+			expected: "broken\n1\n",
+		},
+		{
+			name:     "return from loop",
+			source:   "fun first(xs) { for (x in xs) return x; } print first([4, 5]);",
+			expected: "4\n",
+		},
+		{
+			name:     "C-style loop with initializer expression",
+			source:   "var i; for (i = 0; i < 2; i = i + 1) print i;",
+			expected: "0\n1\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := interpret(t, tc.source, vm.WithStressGC())
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestVMInterpretGenerators(t *testing.T) {
+	testCases := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{
+			name:     "next",
+			source:   "fun gen() { yield 1; yield 2; } var g = gen(); print g.next(); print g.next(); print g.next();",
+			expected: "1\n2\nnil\n",
+		},
+		{
+			name: "done",
+			source: "fun gen() { yield 1; } var g = gen();" +
+				" print g.done(); g.next(); print g.done(); g.next(); print g.done();",
+			expected: "false\nfalse\ntrue\n",
+		},
+		{"print", "fun numbers() { yield 1; } print numbers();", "<generator numbers>\n"},
+		{
+			name:     "lazy",
+			source:   `fun gen() { print "started"; yield 1; } var g = gen(); print "created"; print g.next();`,
+			expected: "created\nstarted\n1\n",
+		},
+		{
+			name:     "arguments and locals",
+			source:   "fun upTo(n) { var i = 0; while (i < n) { yield i; i = i + 1; } } for (i in upTo(3)) print i;",
+			expected: "0\n1\n2\n",
+		},
+		{
+			name:     "return finishes",
+			source:   "fun gen() { yield 1; return 2; yield 3; } for (x in gen()) print x;",
+			expected: "1\n",
+		},
+		{
+			name:     "yield nil in for-in",
+			source:   "fun gen() { yield nil; yield; } var n = 0; for (x in gen()) n = n + 1; print n;",
+			expected: "2\n",
+		},
+		{
+			name:     "independent generators",
+			source:   "fun gen() { yield 1; yield 2; } var a = gen(); var b = gen(); a.next(); print a.next(); print b.next();",
+			expected: "2\n1\n",
+		},
+		{
+			name: "method",
+			source: `
+				class Tree {
+					init(items) { this.items = items; }
+					walk() { for (item in this.items) yield item * 2; }
+				}
+				for (x in Tree([1, 2]).walk()) print x;`,
+			expected: "2\n4\n",
+		},
+		{
+			name: "nested generators",
+			source: `
+				fun inner(n) { for (i in 0..n) yield i; }
+				fun outer() { for (i in 1..3) for (j in inner(i)) yield "${i}:${j}"; }
+				for (x in outer()) print x;`,
+			expected: "1:0\n2:0\n2:1\n",
+		},
+		{
+			name: "upvalues survive suspension",
+			source: `
+				fun gen() {
+					var n = 0;
+					fun get() { return n; }
+					yield get;
+					n = 1;
+					yield nil;
+					n = 2;
+				}
+				var g = gen(); var get = g.next();
+				print get(); g.next(); print get(); g.next(); print get();`,
+			expected: "0\n1\n2\n",
+		},
+		{
+			name: "closure set while suspended",
+			source: `
+				fun gen() {
+					var n = 0;
+					fun set(v) { n = v; }
+					yield set;
+					yield n;
+				}
+				var g = gen(); g.next()(42); print g.next();`,
+			expected: "42\n",
+		},
+		{
+			name: "try across yield",
+			source: `
+				fun gen() {
+					try { yield 1; throw "boom"; } catch (e) { yield "caught " + e; } finally { print "finally"; }
+				}
+				for (x in gen()) print x;`,
+			expected: "1\ncaught boom\nfinally\n",
+		},
+		{
+			name: "exception finishes generator",
+			source: `
+				fun gen() { yield 1; throw "boom"; }
+				var g = gen(); g.next();
+				try { g.next(); } catch (e) { print e; }
+				print g.done(); print g.next();`,
+			expected: "boom\ntrue\nnil\n",
+		},
+		{
+			name: "stream",
+			source: "fun lines() { for (i in 0..1000) yield i; } var total = 0;" +
+				" for (l in lines()) total = total + l; print total;",
+			expected: "499500\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := interpret(t, tc.source, vm.WithStressGC())
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestVMInterpretFibers(t *testing.T) {
+	testCases := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{
+			name:     "script waits for fibers",
+			source:   `fun f() { print "fiber"; } spawn f(); print "script";`,
+			expected: "script\nfiber\n",
+		},
+		{"print", "print channel();", "<channel>\n"},
+		{
+			name: "producer and consumer",
+			source: `
+				fun produce(c, n) { for (i in 0..n) c.send(i); c.close(); }
+				var c = channel(); spawn produce(c, 5);
+				var total = 0; var v = c.recv();
+				while (v != nil) { total = total + v; v = c.recv(); }
+				print total;`,
+			expected: "10\n",
+		},
+		{
+			name: "unbuffered send waits for a receiver",
+			source: `
+				fun f(c) { print "sending"; c.send(1); print "sent"; }
+				var c = channel(); spawn f(c);
+				print "receiving"; print c.recv();`,
+			expected: "receiving\nsending\nsent\n1\n",
+		},
+		{
+			name:     "buffered",
+			source:   "var c = channel(2); c.send(1); c.send(2); print c.recv(); print c.recv();",
+			expected: "1\n2\n",
+		},
+		{
+			name:     "close drains buffer",
+			source:   "var c = channel(3); c.send(1); c.send(2); c.close(); print c.recv(); print c.recv(); print c.recv();",
+			expected: "1\n2\nnil\n",
+		},
+		{
+			name: "full buffer blocks sender",
+			source: `
+				fun f(c) { for (i in 0..3) { c.send(i); print "sent ${i}"; } }
+				var c = channel(1); spawn f(c);
+				c.send(nil); print c.recv(); print c.recv(); print c.recv(); print c.recv();`,
+			expected: "nil\nsent 0\nsent 1\n0\n1\n2\nsent 2\n",
+		},
+		{
+			name: "yield takes turns",
+			source: `
+				fun tick(name) { for (i in 0..2) { print "${name} ${i}"; yield; } }
+				spawn tick("a"); spawn tick("b");`,
+			expected: "a 0\nb 0\na 1\nb 1\n",
+		},
+		{
+			name: "select",
+			source: `
+				fun put(c, v) { c.send(v); }
+				var a = channel(); var b = channel();
+				spawn put(b, "b"); print select(a, b);
+				spawn put(a, "a"); print select(a, b);`,
+			expected: "[1, b]\n[0, a]\n",
+		},
+		{
+			name:     "select ready channel",
+			source:   `var a = channel(1); var b = channel(1); b.send("b"); print select(a, b);`,
+			expected: "[1, b]\n",
+		},
+		{
+			name:     "select closed channel",
+			source:   "var a = channel(); var b = channel(); b.close(); print select(a, b);",
+			expected: "[1, nil]\n",
+		},
+		{
+			name: "select again after waking",
+			source: `
+				fun put(c, v) { c.send(v); }
+				var a = channel(); var b = channel();
+				spawn put(a, 1); print select(a, b);
+				spawn put(a, 2); spawn put(b, 3); print a.recv(); print b.recv();`,
+			expected: "[0, 1]\n2\n3\n",
+		},
+		{
+			name: "fan in",
+			source: `
+				fun square(n, results) { results.send(n * n); }
+				var results = channel();
+				for (i in 1..4) spawn square(i, results);
+				var total = 0; for (i in 1..4) total = total + results.recv();
+				print total;`,
+			expected: "14\n",
+		},
+		{
+			name: "method",
+			source: `
+				class Worker { run(c) { c.send("done"); } }
+				var c = channel(); spawn Worker().run(c); print c.recv();`,
+			expected: "done\n",
+		},
+		{
+			name: "shared upvalues",
+			source: `
+				fun run() {
+					var total = 0; var done = channel();
+					fun add(n) { total = total + n; done.send(nil); }
+					spawn add(1); spawn add(2);
+					done.recv(); done.recv();
+					print total;
+				}
+				run();`,
+			expected: "3\n",
+		},
+		{
+			name: "exceptions stay in their fiber",
+			source: `
+				fun f(c) { try { c.send(1); } catch (e) { print e.message; } }
+				var c = channel(); spawn f(c); spawn c.close();
+				print "done";`,
+			expected: "done\nsend on closed channel\n",
+		},
+		{
+			name: "fiber stack grows",
+			source: `
+				fun f(c) {
+					var x = "captured";
+					fun get() { return x; }
+					var xs = [` + strings.Repeat("0, ", 1000) + `0];
+					x = "updated";
+					c.send("${get()} ${xs.len()}");
+				}
+				var c = channel(); spawn f(c); print c.recv();`,
+			expected: "updated 1001\n",
+		},
+		{
+			name: "many blocked fibers",
+			source: `
+				fun f(c, total) { total.send(c.recv()); }
+				var c = channel(); var total = channel();
+				for (i in 0..2000) spawn f(c, total);
+				for (i in 0..2000) c.send(1);
+				var sum = 0; for (i in 0..2000) sum = sum + total.recv();
+				print sum;`,
+			expected: "2000\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := interpret(t, tc.source, vm.WithStressGC())
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestVMReusableAfterDeadlock(t *testing.T) {
+	var out bytes.Buffer
+
+	vm := vm.NewVM(vm.WithStdout(&out))
+
+	assert.Error(t, vm.Interpret("fun f(c) { c.recv(); } var c = channel(); spawn f(c); spawn f(c); c.recv();"))
+	assert.Empty(t, vm.Stack)
+	assert.NoError(t, vm.Interpret(`var d = channel(1); d.send("ok"); print d.recv();`))
+	assert.Equal(t, "ok\n", out.String())
+}
+
+func TestVMInterpretMatch(t *testing.T) {
+	testCases := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{"literal", `print match 2 { 1 => "one", 2 => "two" };`, "two\n"},
+		{"negative literal", `print match -1 { 1 => "one", -1 => "minus one" };`, "minus one\n"},
+		{"string", `print match "b" { "a" => 1, "b" => 2 };`, "2\n"},
+		{"bool and nil", `print match nil { false => "false", nil => "nil" };`, "nil\n"},
+		{"first arm wins", "print match 1 { 1 => 1, 1 => 2 };", "1\n"},
+		{"trailing comma", "print match 1 { _ => 1, };", "1\n"},
+		{"wildcard", `print match "x" { 1 => 1, _ => "other" };`, "other\n"},
+		{"binding", "print match 21 { n => n * 2 };", "42\n"},
+		{
+			name:     "range",
+			source:   "for (n in [0, 5, 10, 2.5, -3]) print match n { 0..5 => \"low\", 5..10 => \"mid\", _ => \"out\" };",
+			expected: "low\nmid\nout\nlow\nout\n",
+		},
+		{"negative range", `print match -2 { -5..0 => "negative" };`, "negative\n"},
+		{
+			name:     "guard",
+			source:   `for (n in [3, 4]) print match n { x if x % 2 == 0 => "even ${x}", x => "odd ${x}" };`,
+			expected: "odd 3\neven 4\n",
+		},
+		{
+			name: "list",
+			source: `for (v in [[], [1], [1, 2], [1, 2, 3]])` +
+				` print match v { [] => "empty", [x] => x, [x, y] => x + y, _ => "long" };`,
+			expected: "empty\n1\n3\nlong\n",
+		},
+		{"not a list", `print match "ab" { [a, b] => "list", _ => "string" };`, "string\n"},
+		{
+			name:     "nested list",
+			source:   `print match [1, [2, 3]] { [a, [2, b]] => a + b, _ => 0 };`,
+			expected: "4\n",
+		},
+		{
+			name: "map",
+			source: `
+				fun handle(event) {
+					return match event {
+						{"type": "click", "x": x, "y": y} => "click ${x},${y}",
+						{"type": "key", "key": k} if k == "q" => "quit",
+						{"type": t} => "unhandled ${t}",
+						_ => "not an event",
+					};
+				}
+				print handle({"type": "click", "x": 1, "y": 2, "extra": true});
+				print handle({"type": "key", "key": "q"});
+				print handle({"type": "key", "key": "w"});
+				print handle({"kind": "key"});
+				print handle(1);`,
+			expected: "click 1,2\nquit\nunhandled key\nnot an event\nnot an event\n",
+		},
+		{
+			name: "class",
+			source: `
+				class Shape {}
+				class Circle < Shape { init(r) { this.r = r; } }
+				class Rect < Shape { init(w, h) { this.w = w; this.h = h; } }
+				fun area(s) {
+					return match s {
+						Circle { r: 0 } => "point",
+						Circle { r } => 3 * r * r,
+						Rect { w, h } if w == h => "square ${w * h}",
+						Rect { w, h: height } => w * height,
+						Shape {} => "shape",
+					};
+				}
+				print area(Circle(0)); print area(Circle(2)); print area(Rect(2, 2)); print area(Rect(2, 3));
+				print area(Shape());`,
+			expected: "point\n12\nsquare 4\n6\nshape\n",
+		},
+		{
+			name:     "missing field",
+			source:   `class A {} var a = A(); print match a { A { x } => x, A {} => "no x" };`,
+			expected: "no x\n",
+		},
+		{
+			name:     "expression",
+			source:   "var k = 3; var xs = [1, match k { 3 => 10, _ => 0 } * 2]; print xs;",
+			expected: "[1, 20]\n",
+		},
+		{
+			name:     "locals and upvalues",
+			source:   `fun f(a) { var b = 2; return match [a, b] { [x, y] => x + y + a + b }; } print f(1);`,
+			expected: "6\n",
+		},
+		{
+			name:     "nested match",
+			source:   `print match [1, 2] { [a, b] => match a + b { 3 => "three", _ => "other" } };`,
+			expected: "three\n",
+		},
+		{
+			name:     "this",
+			source:   `class A { init() { this.v = 1; } f() { return match this { A { v } => v + 1 }; } } print A().f();`,
+			expected: "2\n",
+		},
+		{"operand", "print 1 + match 2 { n => n * 10 };", "21\n"},
+		{
+			name:     "parenthesized guard",
+			source:   `var ok = true; print match 1 { 1 if (ok) => "yes", _ => "no" };`,
+			expected: "yes\n",
+		},
+		{
+			name: "arrow function in guard",
+			source: `
+				fun any(xs, f) { for (x in xs) if (f(x)) return true; return false; }
+				var xs = [1, 5];
+				for (m in [3, 7]) print match m { m if any(xs, (x) => x > m) => "below", _ => "above" };
+				print match 3 { n if (any(xs, (x) => x > n)) => "paren", _ => "none" };`,
+			expected: "below\nabove\nparen\n",
+		},
+		{
+			name:     "argument",
+			source:   "fun f(a, b, c) { return a + b + c; } print f(1, match 2 { x => x * 10 }, 300);",
+			expected: "321\n",
+		},
+		{
+			name:     "local initializer",
+			source:   "{ var a = 1; var b = match a { 1 => 2 }; var c = a + match b { n => n * 10 }; print [a, b, c]; }",
+			expected: "[1, 2, 21]\n",
+		},
+		{"binding named after declared variable", "{ var x = match 5 { x => x * 2 }; print x; }", "10\n"},
+		{
+			name: "literals and interpolation",
+			source: `{ var k = 1; var xs = [0, 0]; xs[match k { n => n }] = match k { n => n + 1 };` +
+				` print [k, {"a": match k { n => n }}, "${k}${match k { n => n + 2 }}", xs]; }`,
+			expected: "[1, {a: 1}, 13, [0, 2]]\n",
+		},
+		{
+			name:     "captured binding",
+			source:   "var fs = []; for (i in 0..3) fs.push(match i { n => fun () { return n; } }); for (f in fs) print f();",
+			expected: "0\n1\n2\n",
+		},
+		{
+			name:     "deep recursion",
+			source:   "fun sum(n) { return match n { 0 => 0, _ => n + sum(n - 1) }; } print sum(60);",
+			expected: "1830\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := interpret(t, tc.source, vm.WithStressGC())
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestVMInterpretLambdas(t *testing.T) {
+	testCases := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{"fun expression", "var add = fun (a, b) { return a + b; }; print add(1, 2);", "3\n"},
+		{"arrow", "var add = (a, b) => a + b; print add(1, 2);", "3\n"},
+		{"single parameter", "var double = (x) => x * 2; print double(21);", "42\n"},
+		{"no parameters", "var f = () => 1; print f(); print fun () {}();", "1\nnil\n"},
+		{"immediately called", "print ((x) => x + 1)(1);", "2\n"},
+		{"grouping", "var a = 2; print (a); print (a) * 3;", "2\n6\n"},
+		{"name", "print (x) => x;\nprint fun () {};", "<lambda@1>\n<lambda@2>\n"},
+		{
+			name:     "closure",
+			source:   "fun adder(n) { return (x) => x + n; } var add2 = adder(2); print add2(1); print adder(5)(5);",
+			expected: "3\n10\n",
+		},
+		{
+			name: "counter",
+			source: `
+				fun counter() {
+					var count = 0;
+					return fun () { count = count + 1; return count; };
+				}
+				var c = counter(); c(); c(); print c();`,
+			expected: "3\n",
+		},
+		{
+			name: "argument",
+			source: "fun apply(f, xs) { var out = []; for (x in xs) out.push(f(x)); return out; }" +
+				" print apply((x) => x * x, [1, 2, 3]);",
+			expected: "[1, 4, 9]\n",
+		},
+		{"nested", "var add = (a) => (b) => a + b; print add(1)(2);", "3\n"},
+		{"interpolation", `print "${((x) => x * 2)(4)}";`, "8\n"},
+		{
+			name:     "generator",
+			source:   "var gen = fun () { yield 1; yield 2; }; for (x in gen()) print x;",
+			expected: "1\n2\n",
+		},
+		{
+			name:     "method",
+			source:   "class A { init() { this.v = 1; } f() { return () => this.v; } } print A().f()();",
+			expected: "1\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := interpret(t, tc.source, vm.WithStressGC())
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestVMInterpretModules(t *testing.T) {
+	fsys := fstest.MapFS{
+		"lib/util.ato": {Data: []byte(`
+			var greeting = "hello";
+			var _secret = "hidden";
+			fun greet(name) { return greeting + " " + name; }
+			fun secret() { return _secret; }
+			class Point { init(x, y) { this.x = x; this.y = y; } }
+		`)},
+		"lib/counter.ato": {Data: []byte(`
+			print "loading counter";
+			var count = 0;
+			fun increment() { count = count + 1; return count; }
+		`)},
+		"lib/relative.ato": {Data: []byte(`
+			import "util.ato" as util;
+			var message = util.greet("relative");
+		`)},
+		"lib/builtins.ato":  {Data: []byte(`var error = Error("built in"); var twice = double(2);`)},
+		"lib/throws.ato":    {Data: []byte(`throw Error("from module");`)},
+		"lib/broken.ato":    {Data: []byte(`var = 1;`)},
+		"lib/self.ato":      {Data: []byte(`import "self.ato" as self;`)},
+		"lib/ping.ato":      {Data: []byte(`import "pong.ato" as pong;`)},
+		"lib/pong.ato":      {Data: []byte(`import "ping.ato" as ping;`)},
+		"vendor/extra.ato":  {Data: []byte(`var name = "extra";`)},
+		"vendor/shadow.ato": {Data: []byte(`var greeting = "shadowed"; fun get() { return greeting; }`)},
+	}
+
+	testCases := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{"exports", `import "lib/util.ato" as util; print util.greeting;`, "hello\n"},
+		{"call", `import "lib/util.ato" as util; print util.greet("world");`, "hello world\n"},
+		{"method call", `import "lib/util.ato" as util; var p = util.Point(1, 2); print p.x + p.y;`, "3\n"},
+		{"print", `import "lib/util.ato" as util; print util;`, "<module lib/util.ato>\n"},
+		{"private global", `import "lib/util.ato" as util; print util.secret();`, "hidden\n"},
+		{
+			name: "runs once",
+			source: `
+				import "lib/counter.ato" as a;
+				import "lib/counter.ato" as b;
+				print a.increment(); print b.increment(); print a == b;`,
+			expected: "loading counter\n1\n2\ntrue\n",
+		},
+		{"relative import", `import "lib/relative.ato" as r; print r.message;`, "hello relative\n"},
+		{"search path", `import "extra.ato" as extra; print extra.name;`, "extra\n"},
+		{
+			name: "per-module globals",
+			source: `
+				var greeting = "main";
+				import "vendor/shadow.ato" as shadow;
+				print greeting; print shadow.get();`,
+			expected: "main\nshadowed\n",
+		},
+		{
+			name:     "builtins are shared",
+			source:   `import "lib/builtins.ato" as b; print b.error.message; print b.twice;`,
+			expected: "built in\n4\n",
+		},
+		{"local binding", `{ import "lib/util.ato" as util; print util.greeting; }`, "hello\n"},
+		{
+			name: "exception from module",
+			source: `
+				try { import "lib/throws.ato" as throws; } catch (e) { print e.message; }
+				try { import "lib/throws.ato" as throws; } catch (e) { print "again"; }`,
+			expected: "from module\nagain\n",
+		},
+	}
+
+	double := func(args []value.Value) (value.Value, error) {
+		return value.NewInt(2 * args[0].AsInt()), nil
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := interpret(t, tc.source,
+				vm.WithFS(fsys),
+				vm.WithSearchPath("vendor"),
+				vm.WithNative("double", 1, double),
+				vm.WithStressGC(),
+			)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+
+	errorCases := []struct {
+		source  string
+		message string
+	}{
+		{`import "lib/missing.ato" as m;`, "can't find module 'lib/missing.ato'"},
+		{`import "../lib/util.ato" as m;`, "can't find module '../lib/util.ato'"},
+		{`import "lib" as m;`, "can't find module 'lib'"},
+		{`import "lib/util.ato" as util; print util._secret;`, "module 'lib/util.ato' doesn't export '_secret'"},
+		{`import "lib/util.ato" as util; util.missing();`, "module 'lib/util.ato' doesn't export 'missing'"},
+		{`import "lib/self.ato" as m;`, "import cycle through 'lib/self.ato'"},
+		{`import "lib/ping.ato" as m;`, "import cycle through 'lib/ping.ato'"},
+		{`import "lib/throws.ato" as m;`, "from module"},
+		{`import "lib/util.ato" as util; print greet;`, "undefined variable 'greet'"},
+		{
+			`import "lib/broken.ato" as m;`,
+			"can't compile module 'lib/broken.ato': [line 1] error at '=': expect variable name",
+		},
+	}
+
+	for _, tc := range errorCases {
+		t.Run(tc.source, func(t *testing.T) {
+			var rtErr *vm.RuntimeError
+
+			_, err := interpret(t, tc.source, vm.WithFS(fsys))
+			assert.True(t, errors.As(err, &rtErr))
+			assert.Equal(t, tc.message, rtErr.Message)
+		})
+	}
+}
+
+func TestVMImportWithoutFileSystem(t *testing.T) {
+	var rtErr *vm.RuntimeError
+
+	_, err := interpret(t, `import "lib/util.ato" as util;`)
+	assert.True(t, errors.As(err, &rtErr))
+	assert.Equal(t, "can't import 'lib/util.ato': no file system to load scripts from", rtErr.Message)
+
+	assert.ErrorIs(t, vm.NewVM().InterpretFile("main.ato"), vm.ErrNoFileSystem)
+}
+
+func TestVMImportStackTrace(t *testing.T) {
+	var rtErr *vm.RuntimeError
+
+	fsys := fstest.MapFS{
+		"lib/fail.ato": {Data: []byte("var x = 1;\n-nil;")},
+	}
+
+	_, err := interpret(t, "print 1;\nimport \"lib/fail.ato\" as fail;", vm.WithFS(fsys))
+	assert.True(t, errors.As(err, &rtErr))
+	assert.Equal(t, []vm.TraceEntry{
+		{Function: "script lib/fail.ato", Line: 2},
+		{Function: "script", Line: 2},
+	}, rtErr.Trace)
+}
+
+func TestVMInterpretFile(t *testing.T) {
+	var out bytes.Buffer
+
+	fsys := fstest.MapFS{
+		"app/main.ato":   {Data: []byte(`import "helper.ato" as helper; var name = "main"; print helper.name;`)},
+		"app/helper.ato": {Data: []byte(`var name = "helper";`)},
+		"app/cycle.ato":  {Data: []byte(`import "back.ato" as back;`)},
+		"app/back.ato":   {Data: []byte(`import "cycle.ato" as cycle;`)},
+	}
+
+	vm := vm.NewVM(vm.WithFS(fsys), vm.WithStdout(&out))
+
+	assert.NoError(t, vm.InterpretFile("app/main.ato"))
+	assert.NoError(t, vm.Interpret("print name;"))
+	assert.Equal(t, "helper\nmain\n", out.String())
+
+	assert.ErrorContains(t, vm.InterpretFile("app/cycle.ato"), "import cycle through 'app/cycle.ato'")
+	assert.ErrorContains(t, vm.Interpret(`import "back.ato" as back;`), "import cycle through 'app/cycle.ato'")
+	assert.Error(t, vm.InterpretFile("app/missing.ato"))
+}
+
+func TestVMNatives(t *testing.T) {
+	errTooLarge := errors.New("value too large")
+
+	natives := []vm.VMOption{
+		vm.WithNative("double", 1, func(args []value.Value) (value.Value, error) {
+			if args[0].AsInt() > 100 {
+				return value.NewNil(), errTooLarge
+			}
+
+			return value.NewInt(args[0].AsInt() * 2), nil
+		}),
+		vm.WithNative("sum", vm.Variadic, func(args []value.Value) (value.Value, error) {
+			var total int64
+			for _, arg := range args {
+				total += arg.AsInt()
+			}
+
+			return value.NewInt(total), nil
+		}),
+		vm.WithNative("greeting", 0, func(args []value.Value) (value.Value, error) {
+			return value.NewObj(object.NewString("hello")), nil
+		}),
+	}
+
+	testCases := []struct {
+		source   string
+		expected string
+	}{
+		{"print double(21);", "42\n"},
+		{"print double(double(2)) + 1;", "9\n"},
+		{"print sum();", "0\n"},
+		{"print sum(1, 2, 3, 4);", "10\n"},
+		{"var f = sum; print f(5, 5);", "10\n"},
+		{"print double;", "<native fn double>\n"},
+		{`print greeting() == "hello";`, "true\n"},
+		{`fun twice(f, x) { return f(f(x)); } print twice(double, 3);`, "12\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.source, func(t *testing.T) {
+			actual, err := interpret(t, tc.source, append(natives, vm.WithStressGC())...)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+
+	errorCases := []struct {
+		source  string
+		message string
+		line    int
+	}{
+		{"double();", "expected 1 arguments but got 0", 1},
+		{"double(1, 2);", "expected 1 arguments but got 2", 1},
+		{"var x = 1;\nprint double(200);", "value too large", 2},
+		{"fun f() {\n  return double(101);\n}\nf();", "value too large", 2},
+	}
+
+	for _, tc := range errorCases {
+		t.Run(tc.source, func(t *testing.T) {
+			var rtErr *vm.RuntimeError
+
+			vm := vm.NewVM(natives...)
+			err := vm.Interpret(tc.source)
+			assert.True(t, errors.As(err, &rtErr))
+			assert.Equal(t, tc.message, rtErr.Message)
+			assert.Equal(t, tc.line, rtErr.Line)
+			assert.Empty(t, vm.Stack)
+		})
+	}
+}
+
+func interpret(t *testing.T, source string, opts ...vm.VMOption) (string, error) {
+	t.Helper()
+
+	var out bytes.Buffer
+
+	err := vm.NewVM(append(opts, vm.WithStdout(&out))...).Interpret(source)
 
-	assert.NoError(t, vm.Interpret("3+2"))
-	assert.Equal(t, expected, vm.Pop())
+	return out.String(), err
 }